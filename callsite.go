@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+	"github.com/Mellanox/kmtracker/symindex"
+)
+
+// Report grouping of allocations
+const (
+	GroupByFunction = "function" // all call sites of a function together
+	GroupBySite     = "site"     // every call site on its own
+	GroupByModule   = "module"   // all call sites of a module together
+)
+
+func checkGroup(group string) error {
+	switch group {
+	case GroupByFunction, GroupBySite, GroupByModule:
+		return nil
+	}
+	return fmt.Errorf("invalid group %q, use %s, %s or %s", group,
+		GroupByFunction, GroupBySite, GroupByModule)
+}
+
+// setCallSite records the symbol containing the call site of an
+// entry.
+func setCallSite(mementry *MemEntry, sym *symindex.Range) {
+	mementry.call_site_fn = sym.Name
+	mementry.call_site_off = mementry.call_site - sym.Start
+	mementry.call_site_size = sym.Len()
+	mementry.call_site_estimated = sym.Estimated
+	mementry.call_site_mod = sym.Module
+	if sym.Module == "linux_kernel" {
+		mementry.call_site_mod = ""
+	}
+}
+
+// resolveCallSite looks up the symbol of the call site of an entry, it
+// returns false when no symbol covers it.
+func resolveCallSite(symbols *KernelSymbols, mementry *MemEntry) bool {
+	sym := symbols.index.Lookup(mementry.call_site)
+	if sym == nil {
+		return false
+	}
+	setCallSite(mementry, sym)
+	return true
+}
+
+// pageAllocatorFuncs are prefixes of the functions of the page
+// allocator and of the allocation APIs built on it. The call site of a
+// page allocation is the first frame of its stack outside of them.
+var pageAllocatorFuncs = []string{"__alloc_pages", "alloc_pages",
+	"__alloc_frozen_pages", "alloc_frozen_pages", "get_page_from_freelist",
+	"__get_free_pages", "get_zeroed_page", "__folio_alloc", "folio_alloc",
+	"vma_alloc_folio", "__page_frag_alloc", "page_frag_alloc",
+	"__kmalloc_large", "kmalloc_large", "___kmalloc_large", "kmalloc_order"}
+
+func isPageAllocator(name string) bool {
+	for _, prefix := range pageAllocatorFuncs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setStackCallSite sets the call site of a page allocation from the
+// frames of its stack trace.
+func setStackCallSite(mementry *MemEntry, frames []*ftrace.SymbolRef) {
+	for _, frame := range frames {
+		if isPageAllocator(frame.Name) {
+			continue
+		}
+		mementry.call_site_fn = frame.Name
+		mementry.call_site_off = frame.Offset
+		mementry.call_site_size = frame.Size
+		mementry.call_site_mod = frame.Module
+		return
+	}
+}
+
+func moduleSuffix(module string) string {
+	if len(module) == 0 {
+		return ""
+	}
+	return " [" + module + "]"
+}
+
+// callSiteSymbol formats the call site of an entry the way the kernel
+// prints %pS, func+0x1a4/0x300 [module]. Estimated sizes are marked as
+// /~0x300, unresolved call sites are printed as address.
+func callSiteSymbol(mementry *MemEntry) string {
+	if len(mementry.call_site_fn) == 0 {
+		if mementry.call_site == 0 {
+			return ""
+		}
+		return fmt.Sprintf("0x%x", mementry.call_site)
+	}
+	text := fmt.Sprintf("%s+0x%x", mementry.call_site_fn, mementry.call_site_off)
+	if mementry.call_site_estimated {
+		text += fmt.Sprintf("/~0x%x", mementry.call_site_size)
+	} else if mementry.call_site_size != 0 {
+		text += fmt.Sprintf("/0x%x", mementry.call_site_size)
+	}
+	return text + moduleSuffix(mementry.call_site_mod)
+}
+
+// siteKey identifies a call site within one module load, the address
+// of a module call site names another function once it is reloaded.
+type siteKey struct {
+	call_site uint64
+	// set by kernels printing call_site with %pS
+	fn  string
+	off uint64
+	// module events seen before the allocation
+	moduleEvents int
+}
+
+// groupColumn returns the report column title of a grouping.
+func groupColumn(group string) string {
+	if group == GroupBySite {
+		return "call site"
+	}
+	return group
+}
+
+// groupKey returns the name entries are grouped by in reports.
+func groupKey(mementry *MemEntry, group string) string {
+	if group == GroupByModule {
+		switch {
+		case len(mementry.call_site_fn) == 0:
+			return "unknown"
+		case len(mementry.call_site_mod) == 0:
+			return "vmlinux"
+		}
+		return mementry.call_site_mod
+	}
+	if len(mementry.call_site_fn) == 0 && mementry.call_site == 0 {
+		// page allocations traced without stack
+		return "unknown"
+	}
+	if group == GroupBySite || len(mementry.call_site_fn) == 0 {
+		return callSiteSymbol(mementry)
+	}
+	return mementry.call_site_fn + moduleSuffix(mementry.call_site_mod)
+}
+
+// callSiteUsage is the outstanding memory of one call site, function
+// or module.
+type callSiteUsage struct {
+	name  string
+	count uint64
+	bytes uint64
+	// smallest and largest allocation
+	min uint64
+	max uint64
+	// timestamps of the first and last allocation
+	first float64
+	last  float64
+}
+
+func (usage *callSiteUsage) add(mementry *MemEntry) {
+	if usage.count == 0 || mementry.length < usage.min {
+		usage.min = mementry.length
+	}
+	if mementry.length > usage.max {
+		usage.max = mementry.length
+	}
+	if usage.count == 0 || mementry.timestamp < usage.first {
+		usage.first = mementry.timestamp
+	}
+	if mementry.timestamp > usage.last {
+		usage.last = mementry.timestamp
+	}
+	usage.count++
+	usage.bytes += mementry.length
+}
+
+// avg returns the average allocation size.
+func (usage *callSiteUsage) avg() uint64 {
+	if usage.count == 0 {
+		return 0
+	}
+	return usage.bytes / usage.count
+}
+
+// groupOutstanding sums the allocations of trackers not freed yet by
+// group, largest first.
+func groupOutstanding(trackers []*MemEntryTracker, group string) []*callSiteUsage {
+	sites := make(map[string]*callSiteUsage)
+	for _, tracker := range trackers {
+		for _, e := range tracker.entries {
+			if e.freeEntry != nil || e.free_missed {
+				continue
+			}
+			name := groupKey(e, group)
+			usage := sites[name]
+			if usage == nil {
+				usage = &callSiteUsage{name: name}
+				sites[name] = usage
+			}
+			usage.add(e)
+		}
+	}
+
+	usages := make([]*callSiteUsage, 0, len(sites))
+	for _, usage := range sites {
+		usages = append(usages, usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].bytes != usages[j].bytes {
+			return usages[i].bytes > usages[j].bytes
+		}
+		return usages[i].name < usages[j].name
+	})
+	return usages
+}
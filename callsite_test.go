@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Mellanox/kmtracker/symindex"
+)
+
+func TestCallSiteSymbolEstimated(t *testing.T) {
+	for _, test := range []struct {
+		sym  symindex.Range
+		want string
+	}{
+		{symindex.Range{Start: 0x1000, End: 0x12ff, Name: "mlx5_cmd_exec",
+			Module: "mlx5_core"}, "mlx5_cmd_exec+0x1a4/0x300 [mlx5_core]"},
+		{symindex.Range{Start: 0x1000, End: 0x12ff, Name: "mlx5_cmd_exec",
+			Module: "mlx5_core", Estimated: true}, "mlx5_cmd_exec+0x1a4/~0x300 [mlx5_core]"},
+		{symindex.Range{Start: 0x1000, End: 0x12ff, Name: "kmalloc_trace",
+			Module: "linux_kernel", Estimated: true}, "kmalloc_trace+0x1a4/~0x300"},
+	} {
+		mementry := &MemEntry{call_site: 0x11a4}
+		setCallSite(mementry, &test.sym)
+		if text := callSiteSymbol(mementry); text != test.want {
+			t.Errorf("call site %q, want %q", text, test.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package elfsym reads the symbol table of vmlinux and kernel module
+// (.ko) files.
+package elfsym
+
+import (
+	"debug/elf"
+	"io"
+	"strings"
+)
+
+// Symbol is an entry of .symtab.
+type Symbol struct {
+	Name    string
+	Value   uint64
+	Size    uint64
+	Section string // name of the section the symbol is defined in
+	Bind    elf.SymBind
+	Type    elf.SymType
+}
+
+// IsText reports whether section holds kernel code: .text and its
+// .text.* variants, .init.text and .exit.text.
+func IsText(section string) bool {
+	switch {
+	case strings.HasPrefix(section, ".text..refcount"):
+		// out of line refcount error paths, not functions
+		return false
+	case section == ".text", strings.HasPrefix(section, ".text."):
+		return true
+	case section == ".init.text", section == ".exit.text":
+		return true
+	}
+	return false
+}
+
+// ReadSymbols returns the .symtab entries of an ELF file.
+func ReadSymbols(r io.ReaderAt) ([]Symbol, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	symbols := make([]Symbol, 0, len(syms))
+	for _, sym := range syms {
+		s := Symbol{Name: sym.Name, Value: sym.Value, Size: sym.Size,
+			Bind: elf.ST_BIND(sym.Info), Type: elf.ST_TYPE(sym.Info)}
+		if sym.Section < elf.SHN_LORESERVE && int(sym.Section) < len(f.Sections) {
+			s.Section = f.Sections[sym.Section].Name
+		}
+		symbols = append(symbols, s)
+	}
+	return symbols, nil
+}
+
+// TextSizes returns the size of every sized symbol of a code section
+// keyed by name. When a name is defined more than once, as static
+// functions of different files can be, the global definition wins.
+func TextSizes(r io.ReaderAt) (map[string]uint64, error) {
+	symbols, err := ReadSymbols(r)
+	if err != nil {
+		return nil, err
+	}
+	return Sizes(symbols), nil
+}
+
+// Sizes is TextSizes of symbols already read.
+func Sizes(symbols []Symbol) map[string]uint64 {
+	sizes := make(map[string]uint64)
+	global := make(map[string]bool)
+	for _, sym := range symbols {
+		if sym.Size == 0 || len(sym.Name) == 0 || !IsText(sym.Section) {
+			continue
+		}
+		if _, ok := sizes[sym.Name]; ok && (global[sym.Name] || sym.Bind != elf.STB_GLOBAL) {
+			continue
+		}
+		sizes[sym.Name] = sym.Size
+		global[sym.Name] = sym.Bind == elf.STB_GLOBAL
+	}
+	return sizes
+}
+
+// Relocate returns the sized code symbols of a module (.ko) with their
+// load address as Value. Symbol values of a module are offsets in their
+// section, sections maps section names to load addresses as found in
+// /sys/module/<name>/sections. Symbols of sections without an address
+// are left out.
+func Relocate(symbols []Symbol, sections map[string]uint64) []Symbol {
+	var relocated []Symbol
+	for _, sym := range symbols {
+		if sym.Size == 0 || len(sym.Name) == 0 || !IsText(sym.Section) {
+			continue
+		}
+		base, ok := sections[sym.Section]
+		if !ok || base == 0 {
+			continue
+		}
+		sym.Value += base
+		relocated = append(relocated, sym)
+	}
+	return relocated
+}
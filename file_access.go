@@ -32,6 +32,14 @@ func (attrib *FileObject) OpenWO() (err error) {
 	return err
 }
 
+// OpenTrunc opens the file write only and truncates it. For tracefs
+// control files such as trace, set_event and set_event_pid truncation
+// clears the current buffer or selection.
+func (attrib *FileObject) OpenTrunc() (err error) {
+	attrib.File, err = os.OpenFile(attrib.Path, os.O_WRONLY|os.O_TRUNC, 0444)
+	return err
+}
+
 func (attrib *FileObject) Close() (err error) {
 	err = attrib.File.Close()
 	attrib.File = nil
@@ -77,6 +85,22 @@ func (attrib *FileObject) Write(value string) (err error) {
 	return err
 }
 
+// Replace truncates the file and writes value to it.
+func (attrib *FileObject) Replace(value string) (err error) {
+	err = attrib.OpenTrunc()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := attrib.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+	_, err = attrib.File.WriteString(value)
+	return err
+}
+
 func (attrib *FileObject) ReadInt() (value int, err error) {
 	s, err := attrib.Read()
 	if err != nil {
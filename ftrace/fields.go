@@ -0,0 +1,256 @@
+package ftrace
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldKind tells how the value of an event field is printed.
+type FieldKind int
+
+const (
+	KindUnknown  FieldKind = iota
+	KindString             // %s, flags such as gfp_flags
+	KindUnsigned           // %u, %zu, %lu
+	KindSigned             // %d
+	KindHex                // %p, %lx, with or without 0x
+	KindSymbol             // %pS, symbol+off/size [module] or an address
+)
+
+// DefaultKinds is used for fields of events without a format file.
+var DefaultKinds = map[string]FieldKind{
+	"call_site":     KindSymbol,
+	"ptr":           KindHex,
+	"bytes_req":     KindUnsigned,
+	"bytes_alloc":   KindUnsigned,
+	"gfp_flags":     KindString,
+	"node":          KindSigned,
+	"accounted":     KindString,
+	"name":          KindString,
+	"page":          KindHex,
+	"pfn":           KindUnsigned,
+	"order":         KindSigned,
+	"migratetype":   KindSigned,
+	"percpu_refill": KindSigned,
+}
+
+// PositionalFields names the values of events printed without keys,
+// in print order.
+var PositionalFields = map[string][]string{
+	"module_load": {"name", "taints"},
+	"module_free": {"name"},
+}
+
+// Field is a single key=value pair of an event.
+type Field struct {
+	Kind FieldKind
+	Raw  string
+	// set when the value is numeric
+	Numeric bool
+	Uint    uint64
+	Int     int64
+}
+
+// Event is an event name with its typed fields.
+type Event struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+var keyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// FieldParser converts the event part of a trace line into an Event.
+// Field kinds are taken from the event formats when they are known.
+type FieldParser struct {
+	formats map[string]*EventFormat
+}
+
+// NewFieldParser returns a parser using formats, a map of event name
+// to format. formats may be nil.
+func NewFieldParser(formats map[string]*EventFormat) *FieldParser {
+	return &FieldParser{formats: formats}
+}
+
+func (p *FieldParser) kind(event string, key string, value string) FieldKind {
+	if format := p.formats[event]; format != nil {
+		if kind, ok := format.Kind(key); ok {
+			return kind
+		}
+	}
+	if kind, ok := DefaultKinds[key]; ok {
+		return kind
+	}
+	switch {
+	case strings.HasPrefix(value, "0x"):
+		return KindHex
+	case len(value) != 0 && strings.Trim(value, "0123456789") == "":
+		return KindUnsigned
+	case len(value) > 1 && value[0] == '-' &&
+		strings.Trim(value[1:], "0123456789") == "":
+		return KindSigned
+	}
+	return KindString
+}
+
+func newField(kind FieldKind, raw string) *Field {
+	var err error
+
+	field := &Field{Kind: kind, Raw: raw}
+	if raw == "(null)" && kind != KindString {
+		field.Numeric = true
+		return field
+	}
+	switch kind {
+	case KindUnsigned:
+		if strings.HasPrefix(raw, "0x") {
+			// pfn=0x... on newer kernels
+			field.Uint, err = strconv.ParseUint(raw[2:], 16, 64)
+		} else {
+			field.Uint, err = strconv.ParseUint(raw, 10, 64)
+		}
+		field.Int = int64(field.Uint)
+	case KindSigned:
+		field.Int, err = strconv.ParseInt(raw, 10, 64)
+		field.Uint = uint64(field.Int)
+	case KindHex, KindSymbol:
+		field.Uint, err = strconv.ParseUint(strings.TrimPrefix(raw, "0x"), 16, 64)
+		field.Int = int64(field.Uint)
+	default:
+		return field
+	}
+	field.Numeric = err == nil
+	return field
+}
+
+// ParseEvent parses "<event>: key=value key=value ..." in any field
+// order. Values which contain spaces, such as a %pS call site followed
+// by "[module]", are joined back together. Values of the events in
+// PositionalFields are named by their position.
+func (p *FieldParser) ParseEvent(body string) (*Event, error) {
+	i := strings.Index(body, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("event name not found")
+	}
+	event := &Event{Name: strings.TrimSpace(body[:i])}
+	event.Fields = make(map[string]*Field)
+
+	var keys, values []string
+	for _, word := range strings.Fields(body[i+1:]) {
+		if keyRe.MatchString(word) {
+			kv := strings.SplitN(word, "=", 2)
+			keys = append(keys, kv[0])
+			values = append(values, kv[1])
+			continue
+		}
+		if len(values) == 0 {
+			continue
+		}
+		values[len(values)-1] += " " + word
+	}
+
+	for j, key := range keys {
+		kind := p.kind(event.Name, key, values[j])
+		event.Fields[key] = newField(kind, values[j])
+	}
+	if len(keys) == 0 {
+		words := strings.Fields(body[i+1:])
+		for j, name := range PositionalFields[event.Name] {
+			if j < len(words) {
+				event.Fields[name] = newField(KindString, words[j])
+			}
+		}
+	}
+	return event, nil
+}
+
+// Has reports whether the event has the named field.
+func (e *Event) Has(name string) bool {
+	return e.Fields[name] != nil
+}
+
+// Uint returns the numeric value of the named field.
+func (e *Event) Uint(name string) (uint64, error) {
+	field := e.Fields[name]
+	if field == nil {
+		return 0, fmt.Errorf("%s: field %s not found", e.Name, name)
+	}
+	if !field.Numeric {
+		return 0, fmt.Errorf("%s: field %s=%s is not numeric", e.Name, name, field.Raw)
+	}
+	return field.Uint, nil
+}
+
+// Int returns the signed numeric value of the named field.
+func (e *Event) Int(name string) (int64, error) {
+	field := e.Fields[name]
+	if field == nil {
+		return 0, fmt.Errorf("%s: field %s not found", e.Name, name)
+	}
+	if !field.Numeric {
+		return 0, fmt.Errorf("%s: field %s=%s is not numeric", e.Name, name, field.Raw)
+	}
+	return field.Int, nil
+}
+
+// String returns the text of the named field or an empty string.
+func (e *Event) String(name string) string {
+	field := e.Fields[name]
+	if field == nil {
+		return ""
+	}
+	return field.Raw
+}
+
+// SymbolRef is a code address printed as symbol+offset/size [module]
+// by %pS.
+type SymbolRef struct {
+	Name   string
+	Offset uint64
+	Size   uint64 // 0 when not printed
+	Module string // empty for the core kernel
+}
+
+// ParseSymbolRef parses "mlx5_cmd_exec+0x1a4/0x300 [mlx5_core]" and its
+// shorter forms.
+func ParseSymbolRef(text string) *SymbolRef {
+	ref := new(SymbolRef)
+	text = strings.TrimSpace(text)
+	if i := strings.Index(text, " ["); i >= 0 {
+		ref.Module = strings.TrimSuffix(text[i+2:], "]")
+		text = text[:i]
+	}
+	if i := strings.Index(text, "+"); i >= 0 {
+		offset := text[i+1:]
+		text = text[:i]
+		if j := strings.Index(offset, "/"); j >= 0 {
+			ref.Size, _ = strconv.ParseUint(strings.TrimPrefix(offset[j+1:], "0x"), 16, 64)
+			offset = offset[:j]
+		}
+		ref.Offset, _ = strconv.ParseUint(strings.TrimPrefix(offset, "0x"), 16, 64)
+	}
+	ref.Name = text
+	return ref
+}
+
+// Symbol returns the symbol of a %pS printed field, nil when the field
+// holds a plain address.
+func (e *Event) Symbol(name string) *SymbolRef {
+	field := e.Fields[name]
+	if field == nil || field.Kind != KindSymbol || field.Numeric {
+		return nil
+	}
+	return ParseSymbolRef(field.Raw)
+}
+
+// SymbolName returns the function name of a %pS printed field such as
+// "mlx5_cmd_exec+0x1a4/0x300 [mlx5_core]", or an empty string when the
+// field holds a plain address.
+func (e *Event) SymbolName(name string) string {
+	ref := e.Symbol(name)
+	if ref == nil {
+		return ""
+	}
+	return ref.Name
+}
@@ -0,0 +1,82 @@
+package ftrace
+
+import "testing"
+
+func TestParseEvent(t *testing.T) {
+	parser := NewFieldParser(nil)
+	event, err := parser.ParseEvent("kmalloc: call_site=mlx5_cmd_exec+0x1a4/0x300 [mlx5_core] " +
+		"ptr=ffff888100001000 bytes_req=200 bytes_alloc=256 gfp_flags=GFP_KERNEL|__GFP_ZERO node=-1 accounted=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Name != "kmalloc" {
+		t.Errorf("event name %q", event.Name)
+	}
+	for name, want := range map[string]uint64{"ptr": 0xffff888100001000,
+		"bytes_req": 200, "bytes_alloc": 256} {
+		if value, err := event.Uint(name); err != nil || value != want {
+			t.Errorf("%s = %v %v, want %v", name, value, err, want)
+		}
+	}
+	if node, err := event.Int("node"); err != nil || node != -1 {
+		t.Errorf("node = %v %v, want -1", node, err)
+	}
+	if flags := event.String("gfp_flags"); flags != "GFP_KERNEL|__GFP_ZERO" {
+		t.Errorf("gfp_flags = %q", flags)
+	}
+	ref := event.Symbol("call_site")
+	want := SymbolRef{Name: "mlx5_cmd_exec", Offset: 0x1a4, Size: 0x300, Module: "mlx5_core"}
+	if ref == nil || *ref != want {
+		t.Errorf("call_site = %+v, want %+v", ref, want)
+	}
+}
+
+func TestParseEventValues(t *testing.T) {
+	parser := NewFieldParser(nil)
+	for _, test := range []struct {
+		body  string
+		field string
+		want  uint64
+	}{
+		// fields in any order
+		{"kfree: ptr=0000000012345678 call_site=ffffffffc0a1b010", "call_site", 0xffffffffc0a1b010},
+		// pfn is decimal on older kernels and hex on newer ones
+		{"mm_page_alloc: page=0000000012345678 pfn=1048576 order=0", "pfn", 0x100000},
+		{"mm_page_alloc: page=0000000012345678 pfn=0x100000 order=0", "pfn", 0x100000},
+		{"mm_page_alloc: page=(null) pfn=0 order=0", "page", 0},
+	} {
+		event, err := parser.ParseEvent(test.body)
+		if err != nil {
+			t.Errorf("%q: %v", test.body, err)
+			continue
+		}
+		if value, err := event.Uint(test.field); err != nil || value != test.want {
+			t.Errorf("%q: %s = 0x%x %v, want 0x%x", test.body, test.field, value,
+				err, test.want)
+		}
+	}
+
+	event, err := parser.ParseEvent("kfree: call_site=mlx5_cmd_exec+0x10/0x300 [mlx5_core] ptr=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := event.Uint("call_site"); err == nil {
+		t.Errorf("symbol call_site read as a number")
+	}
+	if _, err := event.Uint("bytes_req"); err == nil {
+		t.Errorf("missing field read without error")
+	}
+	if _, err := parser.ParseEvent("no event here"); err == nil {
+		t.Errorf("line without event name parsed")
+	}
+}
+
+func TestParseEventPositional(t *testing.T) {
+	event, err := NewFieldParser(nil).ParseEvent("module_load: mlx5_core OE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.String("name") != "mlx5_core" || event.String("taints") != "OE" {
+		t.Errorf("module_load fields %q %q", event.String("name"), event.String("taints"))
+	}
+}
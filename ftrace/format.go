@@ -0,0 +1,193 @@
+package ftrace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FormatField is one field line of an event format file.
+type FormatField struct {
+	Name   string
+	Type   string
+	Offset int
+	Size   int
+	Signed bool
+}
+
+// EventFormat is the content of a tracefs events/<system>/<event>/format
+// file.
+type EventFormat struct {
+	System   string
+	Name     string
+	ID       int
+	Fields   []FormatField
+	PrintFmt string
+	// key names printed in the text output, in print fmt order
+	PrintFields []string
+
+	// field name to kind, derived from the print fmt conversions
+	kinds map[string]FieldKind
+}
+
+var (
+	formatFieldRe = regexp.MustCompile(
+		`^\s*field:(.+);\s*offset:(\d+);\s*size:(\d+);\s*signed:(\d+);`)
+	printConvRe = regexp.MustCompile(
+		`([A-Za-z_][A-Za-z0-9_]*)=(?:0x)?%[-+ #0]*\d*(?:\.\d+)?(hh|h|ll|l|z|j|t)?([a-zA-Z])([SsFfB])?`)
+	arraySuffixRe = regexp.MustCompile(`\[[^\]]*\]$`)
+)
+
+// parseFieldDecl splits a C declaration such as "const void * ptr" or
+// "__data_loc char[] name" into its type and name.
+func parseFieldDecl(decl string) (string, string) {
+	decl = strings.TrimSpace(decl)
+	i := strings.LastIndexAny(decl, " *")
+	if i < 0 {
+		return "", decl
+	}
+	name := arraySuffixRe.ReplaceAllString(decl[i+1:], "")
+	return strings.TrimSpace(decl[:i+1]), name
+}
+
+// ParseFormat parses an event format file.
+func ParseFormat(r io.Reader) (*EventFormat, error) {
+	format := new(EventFormat)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			format.Name = strings.TrimSpace(strings.TrimPrefix(line, "name:"))
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "ID:")))
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID line %q", line)
+			}
+			format.ID = id
+		case strings.HasPrefix(line, "print fmt:"):
+			format.PrintFmt = strings.TrimSpace(strings.TrimPrefix(line, "print fmt:"))
+		default:
+			m := formatFieldRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			var field FormatField
+			field.Type, field.Name = parseFieldDecl(m[1])
+			field.Offset, _ = strconv.Atoi(m[2])
+			field.Size, _ = strconv.Atoi(m[3])
+			field.Signed = m[4] == "1"
+			format.Fields = append(format.Fields, field)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(format.Name) == 0 {
+		return nil, fmt.Errorf("format name not found")
+	}
+	format.kinds, format.PrintFields = printFmtKinds(format.PrintFmt)
+	return format, nil
+}
+
+// LoadFormat reads and parses the format file at path.
+func LoadFormat(path string) (*EventFormat, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	format, err := ParseFormat(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	format.System = filepath.Base(filepath.Dir(filepath.Dir(path)))
+	return format, nil
+}
+
+// LoadSystemFormats reads the formats of all events of a system, such
+// as kmem, below a tracefs root. It returns nil when they are not
+// available, a FieldParser then falls back to DefaultKinds.
+func LoadSystemFormats(root string, system string) map[string]*EventFormat {
+	paths, err := filepath.Glob(filepath.Join(root, "events", system, "*", "format"))
+	if err != nil || len(paths) == 0 {
+		return nil
+	}
+	formats := make(map[string]*EventFormat)
+	for _, path := range paths {
+		format, err := LoadFormat(path)
+		if err != nil {
+			continue
+		}
+		formats[format.Name] = format
+	}
+	return formats
+}
+
+// printFmtKinds derives the kind of every field from the conversion
+// used for it in the quoted part of the print fmt. It also returns the
+// printed key names in order.
+func printFmtKinds(printFmt string) (map[string]FieldKind, []string) {
+	var names []string
+
+	kinds := make(map[string]FieldKind)
+
+	start := strings.Index(printFmt, "\"")
+	if start < 0 {
+		return kinds, names
+	}
+	end := start + 1
+	for end < len(printFmt) && printFmt[end] != '"' {
+		if printFmt[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(printFmt) {
+		return kinds, names
+	}
+	for _, m := range printConvRe.FindAllStringSubmatch(printFmt[start+1:end], -1) {
+		name, conv, ext := m[1], m[3], m[4]
+		names = append(names, name)
+		switch conv {
+		case "p":
+			if len(ext) != 0 {
+				kinds[name] = KindSymbol
+			} else {
+				kinds[name] = KindHex
+			}
+		case "x", "X":
+			kinds[name] = KindHex
+		case "u":
+			kinds[name] = KindUnsigned
+		case "d", "i":
+			kinds[name] = KindSigned
+		default:
+			kinds[name] = KindString
+		}
+	}
+	return kinds, names
+}
+
+// Kind returns the kind of the named field as printed by the kernel.
+func (format *EventFormat) Kind(name string) (FieldKind, bool) {
+	kind, ok := format.kinds[name]
+	return kind, ok
+}
+
+// Field returns the named field of the binary record layout.
+func (format *EventFormat) Field(name string) *FormatField {
+	for i := range format.Fields {
+		if format.Fields[i].Name == name {
+			return &format.Fields[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package ftrace parses the text output of the kernel function tracer
+// as found in tracefs trace, trace_pipe and trace-cmd report output.
+package ftrace
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Trace output formats
+const (
+	FormatUnknown  = ""
+	FormatTrace    = "trace"      // tracefs trace file
+	FormatPipe     = "trace_pipe" // no header at all
+	FormatTraceCmd = "trace-cmd"  // trace-cmd report output
+)
+
+var (
+	entriesRe   = regexp.MustCompile(`entries-in-buffer/entries-written: (\d+)/(\d+)\s+#P:(\d+)`)
+	cpusRe      = regexp.MustCompile(`^cpus=(\d+)$`)
+	cpuBufferRe = regexp.MustCompile(`^CPU:?\s*\d+ (buffer started|is empty)`)
+	versionRe   = regexp.MustCompile(`^version = \S+$`)
+)
+
+// Header keeps the trace options detected from the comment and marker
+// lines of a trace.
+type Header struct {
+	Format     string
+	Tracer     string
+	CPUs       int
+	Entries    uint64
+	Written    uint64
+	IrqInfo    bool // latency flags column is present
+	RecordTgid bool // TGID column is present
+
+	// number of header lines seen
+	Lines int
+	// set once the first event line is seen
+	dataSeen bool
+}
+
+// IsHeaderLine reports whether line is a comment, marker or empty
+// line rather than an event.
+func IsHeaderLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return true
+	}
+	if strings.HasPrefix(line, "tracer:") {
+		return true
+	}
+	return cpusRe.MatchString(line) || cpuBufferRe.MatchString(line) ||
+		versionRe.MatchString(line)
+}
+
+// ParseLine updates the header with line. It returns true when line
+// is a header line which must not be parsed as an event.
+func (h *Header) ParseLine(line string) bool {
+	if !IsHeaderLine(line) {
+		if !h.dataSeen {
+			h.dataSeen = true
+			if h.Format == FormatUnknown {
+				h.Format = FormatPipe
+			}
+		}
+		return false
+	}
+	h.Lines++
+
+	line = strings.TrimSpace(line)
+	comment := strings.TrimSpace(strings.TrimLeft(line, "#"))
+	switch {
+	case strings.HasPrefix(comment, "tracer:"):
+		h.Tracer = strings.TrimSpace(strings.TrimPrefix(comment, "tracer:"))
+		h.setFormat(FormatTrace)
+	case cpusRe.MatchString(line):
+		h.CPUs, _ = strconv.Atoi(cpusRe.FindStringSubmatch(line)[1])
+		h.setFormat(FormatTraceCmd)
+	case versionRe.MatchString(line):
+		h.setFormat(FormatTraceCmd)
+	case entriesRe.MatchString(comment):
+		m := entriesRe.FindStringSubmatch(comment)
+		h.Entries, _ = strconv.ParseUint(m[1], 10, 64)
+		h.Written, _ = strconv.ParseUint(m[2], 10, 64)
+		h.CPUs, _ = strconv.Atoi(m[3])
+	case strings.Contains(comment, "irqs-off"):
+		h.IrqInfo = true
+	case strings.Contains(comment, "TASK-PID"):
+		if strings.Contains(comment, "TGID") {
+			h.RecordTgid = true
+		}
+	}
+	return true
+}
+
+func (h *Header) setFormat(format string) {
+	if !h.dataSeen && h.Format == FormatUnknown {
+		h.Format = format
+	}
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func (h *Header) String() string {
+	format := h.Format
+	if format == FormatUnknown {
+		format = "unknown"
+	}
+	s := fmt.Sprintf("format=%s", format)
+	if len(h.Tracer) != 0 {
+		s += fmt.Sprintf(" tracer=%s", h.Tracer)
+	}
+	if h.CPUs != 0 {
+		s += fmt.Sprintf(" cpus=%d", h.CPUs)
+	}
+	if h.Format == FormatTrace {
+		s += fmt.Sprintf(" irq-info=%s record-tgid=%s",
+			onOff(h.IrqInfo), onOff(h.RecordTgid))
+	}
+	s += fmt.Sprintf(" header-lines=%d", h.Lines)
+	return s
+}
@@ -0,0 +1,158 @@
+package ftrace
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// lostRe matches the marker ftrace prints in place of dropped events.
+var lostRe = regexp.MustCompile(`^\s*CPU:\s*(\d+) \[LOST (\d+) EVENTS\]`)
+
+// ParseLostLine parses a "CPU:N [LOST M EVENTS]" marker line.
+func ParseLostLine(line string) (cpu int, count uint64, ok bool) {
+	m := lostRe.FindStringSubmatch(line)
+	if m == nil {
+		return 0, 0, false
+	}
+	cpu, _ = strconv.Atoi(m[1])
+	count, _ = strconv.ParseUint(m[2], 10, 64)
+	return cpu, count, true
+}
+
+// LostWindow is a time range of one cpu in which events were dropped.
+// Start is the last event seen on the cpu before the loss and End the
+// first one after it, they are infinite when there is no such event.
+type LostWindow struct {
+	CPU   int
+	Start float64 // seconds
+	End   float64 // seconds
+	// number of lost events, 0 when not known
+	Count  uint64
+	Reason string
+}
+
+func (w *LostWindow) String() string {
+	count := "unknown number of"
+	if w.Count != 0 {
+		count = strconv.FormatUint(w.Count, 10)
+	}
+	return fmt.Sprintf("cpu%d: %s events lost (%s) between %s and %s",
+		w.CPU, count, w.Reason, formatTime(w.Start), formatTime(w.End))
+}
+
+func formatTime(ts float64) string {
+	switch {
+	case math.IsInf(ts, -1):
+		return "trace start"
+	case math.IsInf(ts, 1):
+		return "trace end"
+	}
+	return strconv.FormatFloat(ts, 'f', 6, 64)
+}
+
+// LostEvents collects the windows of lost events of a trace. It is fed
+// with the cpu and timestamp of every event in trace order, of all
+// processes, and with the losses as they are found.
+type LostEvents struct {
+	Windows []*LostWindow
+
+	first map[int]float64
+	last  map[int]float64
+	// windows waiting for the next event of their cpu
+	open map[int][]*LostWindow
+}
+
+func NewLostEvents() *LostEvents {
+	return &LostEvents{first: make(map[int]float64),
+		last: make(map[int]float64), open: make(map[int][]*LostWindow)}
+}
+
+func (le *LostEvents) lastSeen(cpu int) float64 {
+	if ts, ok := le.last[cpu]; ok {
+		return ts
+	}
+	return math.Inf(-1)
+}
+
+// Event records an event of cpu at ts, closing the open windows of
+// the cpu.
+func (le *LostEvents) Event(cpu int, ts float64) {
+	if _, ok := le.first[cpu]; !ok {
+		le.first[cpu] = ts
+	}
+	le.last[cpu] = ts
+	for _, w := range le.open[cpu] {
+		w.End = ts
+	}
+	delete(le.open, cpu)
+}
+
+// Lost records a loss reported by a text marker, it ends at the next
+// event of cpu.
+func (le *LostEvents) Lost(cpu int, count uint64) {
+	w := &LostWindow{CPU: cpu, Start: le.lastSeen(cpu), End: math.Inf(1),
+		Count: count, Reason: "LOST marker"}
+	le.Windows = append(le.Windows, w)
+	le.open[cpu] = append(le.open[cpu], w)
+}
+
+// Missed records a loss of a binary ring buffer page, it ends at the
+// timestamp of the page.
+func (le *LostEvents) Missed(lost Lost) {
+	w := &LostWindow{CPU: lost.CPU, Start: le.lastSeen(lost.CPU),
+		End: float64(lost.Timestamp) / 1e9, Count: lost.Count,
+		Reason: "missed events"}
+	le.Windows = append(le.Windows, w)
+}
+
+// Overrun records events overwritten in the ring buffer of cpu. The
+// oldest events are overwritten so they precede the first event seen.
+func (le *LostEvents) Overrun(cpu int, count uint64) {
+	end := math.Inf(1)
+	if ts, ok := le.first[cpu]; ok {
+		end = ts
+	}
+	le.Windows = append(le.Windows, &LostWindow{CPU: cpu, Start: math.Inf(-1),
+		End: end, Count: count, Reason: "buffer overrun"})
+}
+
+// Dropped records events rejected by the full ring buffer of cpu,
+// they follow the last event seen.
+func (le *LostEvents) Dropped(cpu int, count uint64) {
+	le.Windows = append(le.Windows, &LostWindow{CPU: cpu,
+		Start: le.lastSeen(cpu), End: math.Inf(1), Count: count,
+		Reason: "dropped by full buffer"})
+}
+
+// Sort orders the windows by start time.
+func (le *LostEvents) Sort() {
+	sort.SliceStable(le.Windows, func(i, j int) bool {
+		return le.Windows[i].Start < le.Windows[j].Start
+	})
+}
+
+// WindowAfter returns the first window, of any cpu, which ends after ts.
+// Such a window may hide the free of an object allocated at ts.
+func (le *LostEvents) WindowAfter(ts float64) *LostWindow {
+	for _, w := range le.Windows {
+		if w.End > ts {
+			return w
+		}
+	}
+	return nil
+}
+
+// WindowBefore returns the first window, of any cpu, which starts
+// before ts. Such a window may hide the allocation of an object freed
+// at ts.
+func (le *LostEvents) WindowBefore(ts float64) *LostWindow {
+	for _, w := range le.Windows {
+		if w.Start < ts {
+			return w
+		}
+	}
+	return nil
+}
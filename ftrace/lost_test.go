@@ -0,0 +1,62 @@
+package ftrace
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLostLine(t *testing.T) {
+	cpu, count, ok := ParseLostLine("CPU:3 [LOST 1204 EVENTS]")
+	if !ok || cpu != 3 || count != 1204 {
+		t.Errorf("cpu %v count %v ok %v, want 3 1204 true", cpu, count, ok)
+	}
+	if _, _, ok := ParseLostLine("  bash-42 [001] .... 9.5: kfree: ptr=0"); ok {
+		t.Errorf("event line parsed as a loss")
+	}
+}
+
+func TestLostWindows(t *testing.T) {
+	le := NewLostEvents()
+	le.Event(0, 1.0)
+	le.Event(1, 1.5)
+	le.Lost(0, 10)
+	le.Event(0, 2.0)
+	le.Missed(Lost{CPU: 1, Timestamp: 3e9})
+	le.Overrun(0, 5)
+	le.Dropped(1, 7)
+	le.Sort()
+
+	for _, want := range []LostWindow{
+		{CPU: 0, Start: math.Inf(-1), End: 1.0, Count: 5, Reason: "buffer overrun"},
+		{CPU: 0, Start: 1.0, End: 2.0, Count: 10, Reason: "LOST marker"},
+		{CPU: 1, Start: 1.5, End: 3.0, Reason: "missed events"},
+		{CPU: 1, Start: 1.5, End: math.Inf(1), Count: 7, Reason: "dropped by full buffer"},
+	} {
+		found := false
+		for _, w := range le.Windows {
+			found = found || *w == want
+		}
+		if !found {
+			t.Errorf("window %v not found", &want)
+		}
+	}
+	if len(le.Windows) != 4 {
+		t.Errorf("%v windows, want 4", len(le.Windows))
+	}
+
+	// an allocation before a loss may have lost its free, a free
+	// after a loss may have lost its allocation
+	if w := le.WindowAfter(0.5); w == nil || w.Reason != "buffer overrun" {
+		t.Errorf("window after 0.5 is %v", w)
+	}
+	le2 := NewLostEvents()
+	le2.Event(0, 1.0)
+	le2.Lost(0, 1)
+	le2.Event(0, 2.0)
+	if le2.WindowAfter(2.5) != nil || le2.WindowBefore(0.5) != nil {
+		t.Errorf("window found away from the loss")
+	}
+	if le2.WindowAfter(1.0) == nil || le2.WindowBefore(2.0) == nil {
+		t.Errorf("window not found around the loss")
+	}
+}
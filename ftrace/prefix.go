@@ -0,0 +1,125 @@
+package ftrace
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// The comm is matched greedily so that the pid is taken from the last
+// "-<digits>" before the cpu column, task names may contain dashes and
+// spaces.
+var prefixRe = regexp.MustCompile(
+	`^\s*(.*)-(\d+)\s+(?:\(\s*([-\d]+)\)\s+)?\[(\d+)\]\s+(?:(\S{4,5})\s+)?(\d+(?:\.\d+)?):\s*(.*)$`)
+
+// Flags are the latency format flags of an event.
+type Flags struct {
+	// false when the trace was taken with irq-info off
+	Valid        bool
+	IrqsOff      bool
+	NeedResched  bool
+	HardIrq      bool
+	SoftIrq      bool
+	NMI          bool
+	PreemptDepth int
+}
+
+// Prefix is the part of an event line before the event name.
+type Prefix struct {
+	Comm string
+	Pid  int32
+	// -1 when record-tgid is off or the tgid is unknown
+	Tgid      int32
+	CPU       int
+	Flags     Flags
+	Timestamp float64 // seconds
+}
+
+func parseFlags(s string) (Flags, error) {
+	var flags Flags
+
+	if len(s) < 4 {
+		return flags, fmt.Errorf("invalid flags %q", s)
+	}
+	switch s[0] {
+	case 'd', 'D':
+		flags.IrqsOff = true
+	case '.', 'X':
+	default:
+		return flags, fmt.Errorf("invalid irqs-off flag %q", s)
+	}
+	switch s[1] {
+	case 'N', 'n', 'p', 'L', 'l', 'b', 'B':
+		flags.NeedResched = true
+	case '.':
+	default:
+		return flags, fmt.Errorf("invalid need-resched flag %q", s)
+	}
+	switch s[2] {
+	case 'Z':
+		flags.NMI = true
+		flags.HardIrq = true
+	case 'z':
+		flags.NMI = true
+	case 'H':
+		flags.HardIrq = true
+		flags.SoftIrq = true
+	case 'h':
+		flags.HardIrq = true
+	case 's':
+		flags.SoftIrq = true
+	case '.':
+	default:
+		return flags, fmt.Errorf("invalid hardirq/softirq flag %q", s)
+	}
+	if s[3] != '.' {
+		depth, err := strconv.ParseUint(s[3:4], 16, 8)
+		if err != nil {
+			return flags, fmt.Errorf("invalid preempt-depth %q", s)
+		}
+		flags.PreemptDepth = int(depth)
+	}
+	flags.Valid = true
+	return flags, nil
+}
+
+// ParsePrefix parses the task, pid, tgid, cpu, latency flags and
+// timestamp of an event line. It returns the remainder of the line
+// which starts with the event name.
+func ParsePrefix(line string) (*Prefix, string, error) {
+	m := prefixRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, "", fmt.Errorf("invalid event line")
+	}
+
+	prefix := new(Prefix)
+	prefix.Comm = m[1]
+	pid, err := strconv.ParseInt(m[2], 10, 32)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix.Pid = int32(pid)
+
+	prefix.Tgid = -1
+	if tgid, err := strconv.ParseInt(m[3], 10, 32); err == nil {
+		prefix.Tgid = int32(tgid)
+	}
+
+	prefix.CPU, err = strconv.Atoi(m[4])
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(m[5]) != 0 {
+		prefix.Flags, err = parseFlags(m[5])
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	prefix.Timestamp, err = strconv.ParseFloat(m[6], 64)
+	if err != nil {
+		return nil, "", err
+	}
+	return prefix, m[7], nil
+}
@@ -0,0 +1,54 @@
+package ftrace
+
+import "testing"
+
+func TestParsePrefix(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		want   Prefix
+		remain string
+	}{
+		{"          ibv_rc-1234  [003] .... 12345.000001: kmalloc: ptr=0",
+			Prefix{Comm: "ibv_rc", Pid: 1234, Tgid: -1, CPU: 3,
+				Flags: Flags{Valid: true}, Timestamp: 12345.000001},
+			"kmalloc: ptr=0"},
+		// comm with dashes and spaces, tgid column
+		{"  kworker/u16:2-mm pool-77    (   70) [012] dNh2. 5.5: kfree: ptr=0",
+			Prefix{Comm: "kworker/u16:2-mm pool", Pid: 77, Tgid: 70, CPU: 12,
+				Flags: Flags{Valid: true, IrqsOff: true, NeedResched: true,
+					HardIrq: true, PreemptDepth: 2},
+				Timestamp: 5.5},
+			"kfree: ptr=0"},
+		{"  <idle>-0     (-------) [000] ..Z.. 7.25: mm_page_free: pfn=1",
+			Prefix{Comm: "<idle>", Pid: 0, Tgid: -1, CPU: 0,
+				Flags:     Flags{Valid: true, NMI: true, HardIrq: true},
+				Timestamp: 7.25},
+			"mm_page_free: pfn=1"},
+		// irq-info off
+		{"bash-42 [001] 99.000100: kfree: ptr=0",
+			Prefix{Comm: "bash", Pid: 42, Tgid: -1, CPU: 1, Timestamp: 99.0001},
+			"kfree: ptr=0"},
+	} {
+		prefix, remain, err := ParsePrefix(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if *prefix != test.want || remain != test.remain {
+			t.Errorf("%q: %+v %q, want %+v %q", test.line, *prefix, remain,
+				test.want, test.remain)
+		}
+	}
+}
+
+func TestParsePrefixInvalid(t *testing.T) {
+	for _, line := range []string{
+		"# tracer: nop",
+		" => __alloc_pages+0x1a4/0x300",
+		"bash-42 [001] q... 99.000100: kfree: ptr=0",
+	} {
+		if _, _, err := ParsePrefix(line); err == nil {
+			t.Errorf("%q parsed as an event line", line)
+		}
+	}
+}
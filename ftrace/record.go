@@ -0,0 +1,195 @@
+package ftrace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Bits of common_flags, see include/linux/trace_events.h.
+const (
+	traceFlagIrqsOff        = 0x01
+	traceFlagIrqsNoSupport  = 0x02
+	traceFlagNeedResched    = 0x04
+	traceFlagHardirq        = 0x08
+	traceFlagSoftirq        = 0x10
+	traceFlagPreemptResched = 0x20
+	traceFlagNMI            = 0x40
+)
+
+// Decoder decodes binary ring buffer records into events using the
+// formats of the traced kernel.
+type Decoder struct {
+	order binary.ByteOrder
+	// event id to format
+	formats map[int]*EventFormat
+	// pid to task name, from saved_cmdlines
+	comms map[int32]string
+}
+
+// NewDecoder returns a decoder for records of the given byte order.
+// comms may be nil.
+func NewDecoder(order binary.ByteOrder, formats []*EventFormat,
+	comms map[int32]string) *Decoder {
+	d := &Decoder{order: order, comms: comms}
+	d.formats = make(map[int]*EventFormat)
+	for _, format := range formats {
+		d.formats[format.ID] = format
+	}
+	return d
+}
+
+// ParseCmdlines parses saved_cmdlines content, "<pid> <comm>" lines.
+func ParseCmdlines(text string) map[int32]string {
+	comms := make(map[int32]string)
+	for _, line := range strings.Split(text, "\n") {
+		var pid int32
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := fmt.Sscan(parts[0], &pid); err != nil {
+			continue
+		}
+		comms[pid] = parts[1]
+	}
+	return comms
+}
+
+func (d *Decoder) readUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(d.order.Uint16(b))
+	case 4:
+		return uint64(d.order.Uint32(b))
+	case 8:
+		return d.order.Uint64(b)
+	}
+	return 0
+}
+
+func signExtend(value uint64, size int) int64 {
+	shift := uint(64 - size*8)
+	return int64(value<<shift) >> shift
+}
+
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// fieldKind returns the kind of a binary field, the print fmt kind is
+// preferred so that text and binary events look the same.
+func fieldKind(format *EventFormat, field *FormatField) FieldKind {
+	if kind, ok := format.Kind(field.Name); ok && kind != KindString {
+		return kind
+	}
+	switch {
+	case strings.Contains(field.Type, "*"):
+		return KindHex
+	case field.Signed:
+		return KindSigned
+	}
+	return KindUnsigned
+}
+
+func (d *Decoder) decodeField(format *EventFormat, field *FormatField,
+	data []byte) (*Field, error) {
+	if field.Offset+field.Size > len(data) {
+		return nil, fmt.Errorf("%s: field %s out of record", format.Name, field.Name)
+	}
+	raw := data[field.Offset : field.Offset+field.Size]
+
+	switch {
+	case strings.HasPrefix(field.Type, "__data_loc"):
+		// offset in the low and length in the high 16 bits
+		loc := d.readUint(raw)
+		offset, length := int(loc&0xffff), int(loc>>16)
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("%s: field %s out of record", format.Name, field.Name)
+		}
+		return &Field{Kind: KindString, Raw: cString(data[offset : offset+length])}, nil
+	case strings.HasPrefix(field.Type, "char") && field.Size > 1:
+		return &Field{Kind: KindString, Raw: cString(raw)}, nil
+	case field.Size != 1 && field.Size != 2 && field.Size != 4 && field.Size != 8:
+		return &Field{Kind: KindString, Raw: fmt.Sprintf("%x", raw)}, nil
+	}
+
+	f := &Field{Kind: fieldKind(format, field), Numeric: true}
+	f.Uint = d.readUint(raw)
+	f.Int = int64(f.Uint)
+	if field.Signed {
+		f.Int = signExtend(f.Uint, field.Size)
+	}
+	switch f.Kind {
+	case KindSigned:
+		f.Raw = fmt.Sprintf("%d", f.Int)
+	case KindHex, KindSymbol:
+		f.Raw = fmt.Sprintf("%x", f.Uint)
+	default:
+		f.Raw = fmt.Sprintf("%d", f.Uint)
+	}
+	return f, nil
+}
+
+func decodeFlags(flags uint64, preemptCount uint64) Flags {
+	f := Flags{Valid: flags&traceFlagIrqsNoSupport == 0}
+	f.IrqsOff = flags&traceFlagIrqsOff != 0
+	f.NeedResched = flags&(traceFlagNeedResched|traceFlagPreemptResched) != 0
+	f.HardIrq = flags&traceFlagHardirq != 0
+	f.SoftIrq = flags&traceFlagSoftirq != 0
+	f.NMI = flags&traceFlagNMI != 0
+	f.PreemptDepth = int(preemptCount & 0xf)
+	return f
+}
+
+// Decode converts a record into the prefix and event a text trace
+// would show for it. Fields are named as in the format, common fields
+// go to the prefix.
+func (d *Decoder) Decode(rec *Record) (*Prefix, *Event, error) {
+	if len(rec.Data) < 2 {
+		return nil, nil, fmt.Errorf("short record")
+	}
+	id := int(d.order.Uint16(rec.Data))
+	format := d.formats[id]
+	if format == nil {
+		return nil, nil, fmt.Errorf("unknown event id %d", id)
+	}
+
+	prefix := &Prefix{CPU: rec.CPU, Tgid: -1}
+	prefix.Timestamp = float64(rec.Timestamp) / 1e9
+	event := &Event{Name: format.Name, Fields: make(map[string]*Field)}
+
+	var flags, preemptCount uint64
+	for i := range format.Fields {
+		field := &format.Fields[i]
+		f, err := d.decodeField(format, field, rec.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch field.Name {
+		case "common_type":
+		case "common_flags":
+			flags = f.Uint
+		case "common_preempt_count":
+			preemptCount = f.Uint
+		case "common_pid":
+			prefix.Pid = int32(f.Int)
+		default:
+			if strings.HasPrefix(field.Name, "common_") {
+				continue
+			}
+			event.Fields[field.Name] = f
+		}
+	}
+	prefix.Flags = decodeFlags(flags, preemptCount)
+	prefix.Comm = d.comms[prefix.Pid]
+	if len(prefix.Comm) == 0 {
+		prefix.Comm = "<...>"
+	}
+	return prefix, event, nil
+}
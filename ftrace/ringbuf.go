@@ -0,0 +1,307 @@
+package ftrace
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Ring buffer event header types, see kernel/trace/ring_buffer.c.
+const (
+	typeLenPadding    = 29
+	typeLenTimeExtend = 30
+	typeLenTimeStamp  = 31
+
+	timeDeltaBits = 27
+
+	commitMask   = (1 << 27) - 1
+	missedEvents = 1 << 31
+	missedStored = 1 << 30
+)
+
+// PageHeader is the layout of a ring buffer page header as described by
+// events/header_page.
+type PageHeader struct {
+	TimestampOffset int
+	CommitOffset    int
+	CommitSize      int
+	DataOffset      int
+	// size of a page, the end of the data field, 0 when not known
+	PageSize int
+}
+
+// DefaultPageHeader returns the page header used by the kernel for the
+// given size of long.
+func DefaultPageHeader(longSize int) *PageHeader {
+	return &PageHeader{TimestampOffset: 0, CommitOffset: 8,
+		CommitSize: longSize, DataOffset: 8 + longSize}
+}
+
+// ParsePageHeader parses the content of events/header_page.
+func ParsePageHeader(text string) (*PageHeader, error) {
+	var found int
+
+	hdr := new(PageHeader)
+	for _, line := range strings.Split(text, "\n") {
+		m := formatFieldRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		var field FormatField
+		_, field.Name = parseFieldDecl(m[1])
+		fmt.Sscan(m[2], &field.Offset)
+		fmt.Sscan(m[3], &field.Size)
+		switch field.Name {
+		case "timestamp":
+			hdr.TimestampOffset = field.Offset
+			found++
+		case "commit":
+			hdr.CommitOffset = field.Offset
+			hdr.CommitSize = field.Size
+			found++
+		case "data":
+			hdr.DataOffset = field.Offset
+			hdr.PageSize = field.Offset + field.Size
+			found++
+		}
+	}
+	if found != 3 {
+		return nil, fmt.Errorf("invalid header_page")
+	}
+	return hdr, nil
+}
+
+// Record is one event read from a ring buffer page.
+type Record struct {
+	CPU       int
+	Timestamp uint64 // ns
+	Data      []byte
+	// events dropped on the cpu right before this record, nil if none
+	Lost *Lost
+}
+
+// Lost describes events dropped by the kernel before a page.
+type Lost struct {
+	CPU       int
+	Timestamp uint64 // ns, timestamp of the page after the loss
+	// number of lost events, 0 when the kernel did not store it
+	Count uint64
+}
+
+// CPUReader reads the records of one cpu from a stream of ring buffer
+// pages, such as per_cpu/cpuN/trace_pipe_raw or the cpu data of a
+// trace.dat file.
+type CPUReader struct {
+	CPU      int
+	r        io.Reader
+	order    binary.ByteOrder
+	pageSize int
+	hdr      *PageHeader
+
+	page   []byte
+	data   []byte // events of the current page
+	offset int
+	ts     uint64
+	missed []Lost
+	// loss to report with the next record
+	pending *Lost
+}
+
+func NewCPUReader(cpu int, r io.Reader, order binary.ByteOrder,
+	pageSize int, hdr *PageHeader) *CPUReader {
+	return &CPUReader{CPU: cpu, r: bufio.NewReaderSize(r, pageSize*4),
+		order: order, pageSize: pageSize, hdr: hdr,
+		page: make([]byte, pageSize)}
+}
+
+func (cr *CPUReader) readUint(b []byte, size int) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(cr.order.Uint16(b))
+	case 4:
+		return uint64(cr.order.Uint32(b))
+	default:
+		return cr.order.Uint64(b)
+	}
+}
+
+func (cr *CPUReader) nextPage() error {
+	_, err := io.ReadFull(cr.r, cr.page)
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	hdr := cr.hdr
+	cr.ts = cr.order.Uint64(cr.page[hdr.TimestampOffset:])
+	commit := cr.readUint(cr.page[hdr.CommitOffset:], hdr.CommitSize)
+	size := int(commit & commitMask)
+	if hdr.DataOffset+size > len(cr.page) {
+		return fmt.Errorf("cpu%d: invalid page commit %d", cr.CPU, size)
+	}
+	cr.data = cr.page[hdr.DataOffset : hdr.DataOffset+size]
+	cr.offset = 0
+
+	if commit&missedEvents != 0 {
+		lost := Lost{CPU: cr.CPU, Timestamp: cr.ts}
+		end := hdr.DataOffset + size
+		if commit&missedStored != 0 && end+hdr.CommitSize <= len(cr.page) {
+			lost.Count = cr.readUint(cr.page[end:], hdr.CommitSize)
+		}
+		cr.missed = append(cr.missed, lost)
+		cr.pending = &lost
+	}
+	return nil
+}
+
+// Missed returns the losses found so far.
+func (cr *CPUReader) Missed() []Lost {
+	return cr.missed
+}
+
+// Next returns the next event record. It returns io.EOF at the end of
+// the stream.
+func (cr *CPUReader) Next() (*Record, error) {
+	for {
+		if cr.offset+4 > len(cr.data) {
+			err := cr.nextPage()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		hdr := cr.order.Uint32(cr.data[cr.offset:])
+		var typeLen, delta uint32
+		if cr.order == binary.BigEndian {
+			typeLen = hdr >> timeDeltaBits
+			delta = hdr & ((1 << timeDeltaBits) - 1)
+		} else {
+			typeLen = hdr & 0x1f
+			delta = hdr >> 5
+		}
+		body := cr.offset + 4
+
+		switch {
+		case typeLen == typeLenPadding:
+			if delta == 0 || body+4 > len(cr.data) {
+				// rest of the page is unused
+				cr.offset = len(cr.data)
+				continue
+			}
+			cr.offset = body + int(cr.order.Uint32(cr.data[body:]))
+			cr.ts += uint64(delta)
+		case typeLen == typeLenTimeExtend:
+			if body+4 > len(cr.data) {
+				return nil, fmt.Errorf("cpu%d: truncated time extend", cr.CPU)
+			}
+			ext := uint64(cr.order.Uint32(cr.data[body:]))
+			cr.ts += ext<<timeDeltaBits + uint64(delta)
+			cr.offset = body + 4
+		case typeLen == typeLenTimeStamp:
+			if body+4 > len(cr.data) {
+				return nil, fmt.Errorf("cpu%d: truncated time stamp", cr.CPU)
+			}
+			ext := uint64(cr.order.Uint32(cr.data[body:]))
+			cr.ts = ext<<timeDeltaBits + uint64(delta)
+			cr.offset = body + 4
+		default:
+			var length int
+			if typeLen == 0 {
+				if body+4 > len(cr.data) {
+					cr.offset = len(cr.data)
+					continue
+				}
+				length = int(cr.order.Uint32(cr.data[body:])) - 4
+				length = (length + 3) &^ 3
+				body += 4
+			} else {
+				length = int(typeLen) * 4
+			}
+			if length < 0 || body+length > len(cr.data) {
+				return nil, fmt.Errorf("cpu%d: invalid event length %d", cr.CPU, length)
+			}
+			cr.ts += uint64(delta)
+			cr.offset = body + length
+			// the page buffer is reused, records outlive it
+			data := make([]byte, length)
+			copy(data, cr.data[body:])
+			rec := &Record{CPU: cr.CPU, Timestamp: cr.ts, Data: data, Lost: cr.pending}
+			cr.pending = nil
+			return rec, nil
+		}
+	}
+}
+
+// RecordReader is a source of records ordered by time.
+type RecordReader interface {
+	Next() (*Record, error)
+}
+
+type mergeItem struct {
+	rec    *Record
+	reader RecordReader
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].rec.Timestamp < h[j].rec.Timestamp }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Merger merges the records of several per cpu readers by timestamp.
+type Merger struct {
+	heap    mergeHeap
+	readers []RecordReader
+	started bool
+}
+
+func NewMerger(readers ...RecordReader) *Merger {
+	return &Merger{readers: readers}
+}
+
+func (m *Merger) push(reader RecordReader) error {
+	rec, err := reader.Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&m.heap, &mergeItem{rec: rec, reader: reader})
+	return nil
+}
+
+// Next returns the oldest record of all readers, io.EOF when all of
+// them are exhausted.
+func (m *Merger) Next() (*Record, error) {
+	if !m.started {
+		m.started = true
+		for _, reader := range m.readers {
+			if err := m.push(reader); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(m.heap) == 0 {
+		return nil, io.EOF
+	}
+	item := heap.Pop(&m.heap).(*mergeItem)
+	if err := m.push(item.reader); err != nil {
+		return nil, err
+	}
+	return item.rec, nil
+}
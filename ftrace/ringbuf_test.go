@@ -0,0 +1,50 @@
+package ftrace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testPageSize = 64
+
+// testPage builds a little endian ring buffer page holding the given
+// event words.
+func testPage(ts uint64, words ...uint32) []byte {
+	page := make([]byte, testPageSize)
+	binary.LittleEndian.PutUint64(page, ts)
+	binary.LittleEndian.PutUint64(page[8:], uint64(len(words)*4))
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(page[16+i*4:], word)
+	}
+	return page
+}
+
+func testReader(page []byte) *CPUReader {
+	return NewCPUReader(0, bytes.NewReader(page), binary.LittleEndian,
+		testPageSize, DefaultPageHeader(8))
+}
+
+func TestCPUReaderTimeExtend(t *testing.T) {
+	// time extend of 1<<27+3 ns then a 4 byte event 2 ns later
+	cr := testReader(testPage(100, 3<<5|typeLenTimeExtend, 1, 2<<5|1, 0xabcd))
+	rec, err := cr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(100 + 1<<27 + 3 + 2); rec.Timestamp != want {
+		t.Errorf("timestamp %v, want %v", rec.Timestamp, want)
+	}
+	if len(rec.Data) != 4 || binary.LittleEndian.Uint32(rec.Data) != 0xabcd {
+		t.Errorf("data %x", rec.Data)
+	}
+}
+
+func TestCPUReaderTruncated(t *testing.T) {
+	for _, typeLen := range []uint32{typeLenTimeExtend, typeLenTimeStamp} {
+		cr := testReader(testPage(100, typeLen))
+		if _, err := cr.Next(); err == nil {
+			t.Errorf("type %v: truncated page read without error", typeLen)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package ftrace
+
+import "strings"
+
+// StackTraceEvent is the event part of the entry the stacktrace trigger
+// adds after the event it fired on. The frames follow it one per line.
+const StackTraceEvent = "<stack trace>"
+
+// ParseStackLine parses a frame line of a stack trace such as
+// " => mlx5e_alloc_rx_mpwqe+0x1a4/0x300 [mlx5_core]".
+func ParseStackLine(line string) (*SymbolRef, bool) {
+	text := strings.TrimSpace(line)
+	if !strings.HasPrefix(text, "=> ") {
+		return nil, false
+	}
+	return ParseSymbolRef(text[3:]), true
+}
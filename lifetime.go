@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+)
+
+// allocFamily returns the API family of an allocation event, the frees
+// of the same family are the ones meant for it. It returns "" for other
+// events.
+func allocFamily(call_type string) string {
+	switch call_type {
+	case "kmalloc", "kmalloc_node":
+		return "kmalloc"
+	case "kmem_cache_alloc":
+		return "kmem_cache"
+	case "mm_page_alloc":
+		return "page"
+	}
+	return ""
+}
+
+// freeFamily returns the API family of a free event, "" for other
+// events. kvfree and kfree_rcu of slab objects are traced as kfree.
+func freeFamily(call_type string) string {
+	switch call_type {
+	case "kfree":
+		return "kmalloc"
+	case "kmem_cache_free":
+		return "kmem_cache"
+	case "mm_page_free", "mm_page_free_batched":
+		return "page"
+	}
+	return ""
+}
+
+func isPageEvent(call_type string) bool {
+	return allocFamily(call_type) == "page" || freeFamily(call_type) == "page"
+}
+
+// lifetimeKey returns what pairs an entry with its allocation or free,
+// the first page for page events and the pointer for slab events. It
+// returns false when there is nothing to pair.
+func lifetimeKey(mementry *MemEntry) (uint64, bool) {
+	if isPageEvent(mementry.call_type) {
+		return mementry.pfn, mementry.pfn != noPfn
+	}
+	// kfree(NULL) is valid in kernel
+	return mementry.ptr, mementry.ptr != 0
+}
+
+// doubleFree is a free of a pointer already freed.
+type doubleFree struct {
+	entry *MemEntry
+	// the earlier free of the pointer
+	previous *MemEntry
+}
+
+// LifetimeMatcher pairs allocations and frees. Entries must be added in
+// time order, a free then releases the allocation holding its pointer
+// at that time, so a pointer reused many times pairs every free with
+// its own allocation. Slab allocators share one address space, so a
+// single table serves every allocator and any free releases the object
+// at its pointer, whichever API allocated it. Pages are paired by pfn
+// in a matcher of their own.
+type LifetimeMatcher struct {
+	// pointer to the allocation currently holding it
+	live map[uint64]*MemEntry
+	// pointer to its last free, while it is not allocated again. The
+	// free is nil when entries are not kept.
+	freed map[uint64]*MemEntry
+	// keep tells whether the entries of the issues are listed, only
+	// their counts are kept otherwise
+	keep bool
+
+	doubleFreeCount  int
+	unknownFreeCount int
+	missedFreeCount  int
+	mismatchCount    int
+
+	doubleFrees []*doubleFree
+	// frees of pointers not allocated in the trace
+	unknownFrees []*MemEntry
+	// allocations whose pointer was allocated again without a free,
+	// the free was not traced
+	missedFrees []*MemEntry
+	// frees of another API family than their allocation, such as
+	// kfree of a kmem_cache_alloc object
+	mismatches []*MemEntry
+}
+
+// NewLifetimeMatcher returns a matcher listing the entries of the
+// issues when keep is set, counting them only otherwise so that memory
+// use does not grow with the length of the trace.
+func NewLifetimeMatcher(keep bool) *LifetimeMatcher {
+	return &LifetimeMatcher{live: make(map[uint64]*MemEntry),
+		freed: make(map[uint64]*MemEntry), keep: keep}
+}
+
+// Add processes the next entry. For a free it returns the allocation
+// it released, nil when there is none.
+func (lm *LifetimeMatcher) Add(mementry *MemEntry) *MemEntry {
+	key, ok := lifetimeKey(mementry)
+	if !ok {
+		return nil
+	}
+	if len(allocFamily(mementry.call_type)) != 0 {
+		if prev := lm.live[key]; prev != nil {
+			prev.free_missed = true
+			lm.missedFreeCount++
+			if lm.keep {
+				lm.missedFrees = append(lm.missedFrees, prev)
+			}
+		}
+		lm.live[key] = mementry
+		delete(lm.freed, key)
+		return nil
+	}
+	family := freeFamily(mementry.call_type)
+	if len(family) == 0 {
+		return nil
+	}
+	alloc := lm.live[key]
+	if alloc == nil {
+		if prev, ok := lm.freed[key]; ok {
+			lm.doubleFreeCount++
+			if lm.keep {
+				lm.doubleFrees = append(lm.doubleFrees,
+					&doubleFree{entry: mementry, previous: prev})
+			}
+		} else {
+			lm.unknownFreeCount++
+			if lm.keep {
+				lm.unknownFrees = append(lm.unknownFrees, mementry)
+			}
+		}
+		return nil
+	}
+	if allocFamily(alloc.call_type) != family {
+		lm.mismatchCount++
+		if lm.keep {
+			lm.mismatches = append(lm.mismatches, mementry)
+		}
+	}
+	alloc.freeEntry = mementry
+	mementry.freeEntry = alloc
+	delete(lm.live, key)
+	if lm.keep {
+		lm.freed[key] = mementry
+	} else {
+		lm.freed[key] = nil
+	}
+	return alloc
+}
+
+// freeTracker returns the tracker of a free event.
+func (memEntries *MemEntrieByType) freeTracker(call_type string) *MemEntryTracker {
+	switch call_type {
+	case "kfree":
+		return &memEntries.kfree
+	case "kmem_cache_free":
+		return &memEntries.kmem_cache_free
+	}
+	return nil
+}
+
+// accountFree sets the length of a free paired with alloc and adds it
+// to the freed totals.
+func (memEntries *MemEntrieByType) accountFree(freeentry *MemEntry, alloc *MemEntry) {
+	freeentry.length = alloc.length
+	if tracker := memEntries.freeTracker(freeentry.call_type); tracker != nil {
+		tracker.size += alloc.length
+	}
+	memEntries.freeSize += alloc.length
+}
+
+// unreliableText returns the lost events note of an entry, empty when
+// no events were lost around it.
+func unreliableText(lost *ftrace.LostEvents, mementry *MemEntry) string {
+	if w := lostWindow(lost, mementry); w != nil {
+		return " (unreliable, " + w.String() + ")"
+	}
+	return ""
+}
+
+// keyText formats what an entry is paired by.
+func keyText(mementry *MemEntry) string {
+	if isPageEvent(mementry.call_type) {
+		return fmt.Sprintf("pfn=0x%x", mementry.pfn)
+	}
+	return fmt.Sprintf("ptr=0x%x", mementry.ptr)
+}
+
+// printIssueEntries lists the double frees, unknown frees, untraced
+// frees and mismatched frees of a matcher.
+func printIssueEntries(lm *LifetimeMatcher, lost *ftrace.LostEvents) {
+	for _, df := range lm.doubleFrees {
+		fmt.Printf("double free %v %v %v %v, freed before by %v %v %v%s\n",
+			df.entry.call_type, callSiteText(df.entry), keyText(df.entry),
+			df.entry.index, df.previous.call_type,
+			callSiteText(df.previous), df.previous.index,
+			unreliableText(lost, df.entry))
+	}
+	for _, e := range lm.unknownFrees {
+		fmt.Printf("unknown free %v %v %v %v%s\n", e.call_type,
+			callSiteText(e), keyText(e), e.index, unreliableText(lost, e))
+	}
+	for _, e := range lm.missedFrees {
+		fmt.Printf("free not traced %v %v %v %v %v\n", e.call_type,
+			callSiteText(e), keyText(e), e.length, e.index)
+	}
+	for _, e := range lm.mismatches {
+		fmt.Printf("mismatched free %v %v %v %v of %v %v %v\n",
+			e.call_type, callSiteText(e), keyText(e), e.index,
+			e.freeEntry.call_type, callSiteText(e.freeEntry), e.freeEntry.index)
+	}
+}
+
+// printFreeIssues reports double frees, frees of unknown pointers,
+// allocations whose free was not traced and frees of another API than
+// their allocation, each entry when verbose. Pages follow, by pfn.
+func printFreeIssues(memEntries *MemEntrieByType, verbose bool) {
+	lm := memEntries.lifetimes
+	if lm == nil {
+		return
+	}
+	lost := memEntries.lost
+
+	fmt.Println("-------------------------------------------------")
+	fmt.Printf("Double frees = %v\n", lm.doubleFreeCount)
+	fmt.Printf("Frees of pointers not allocated in the trace = %v\n", lm.unknownFreeCount)
+	fmt.Printf("Allocations reused without a traced free = %v\n", lm.missedFreeCount)
+	fmt.Printf("Frees with another API than the allocation = %v\n", lm.mismatchCount)
+	pm := memEntries.pageLifetimes
+	if pm != nil && memEntries.mm_page_alloc.count != 0 {
+		fmt.Printf("Page double frees = %v\n", pm.doubleFreeCount)
+		fmt.Printf("Page frees of pages not allocated in the trace = %v\n", pm.unknownFreeCount)
+		fmt.Printf("Page allocations reused without a traced free = %v\n", pm.missedFreeCount)
+	}
+	if !verbose {
+		return
+	}
+	printIssueEntries(lm, lost)
+	if pm != nil {
+		printIssueEntries(pm, lost)
+	}
+}
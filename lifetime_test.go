@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+)
+
+// testEntries builds entries of cpu 0 one microsecond apart.
+type testEntries struct {
+	index int
+}
+
+func (te *testEntries) next(call_type string, ptr uint64, length uint64) *MemEntry {
+	te.index++
+	return &MemEntry{call_type: call_type, ptr: ptr, length: length,
+		timestamp: 100 + float64(te.index)/1e6, index: te.index}
+}
+
+func TestLifetimeReuse(t *testing.T) {
+	var te testEntries
+	lm := NewLifetimeMatcher(true)
+
+	first := te.next("kmalloc", 0x1000, 64)
+	firstFree := te.next("kfree", 0x1000, 0)
+	second := te.next("kmalloc", 0x1000, 128)
+	secondFree := te.next("kfree", 0x1000, 0)
+	for _, e := range []*MemEntry{first, firstFree, second, secondFree} {
+		lm.Add(e)
+	}
+	if first.freeEntry != firstFree || second.freeEntry != secondFree {
+		t.Errorf("frees of a reused pointer paired with the wrong allocation")
+	}
+	if firstFree.freeEntry != first || secondFree.freeEntry != second {
+		t.Errorf("allocations of a reused pointer paired with the wrong free")
+	}
+	if lm.doubleFreeCount+lm.unknownFreeCount+lm.missedFreeCount+lm.mismatchCount != 0 {
+		t.Errorf("double %v unknown %v missed %v mismatched %v frees, want none",
+			lm.doubleFreeCount, lm.unknownFreeCount, lm.missedFreeCount,
+			lm.mismatchCount)
+	}
+}
+
+func TestLifetimeDoubleFree(t *testing.T) {
+	var te testEntries
+	lm := NewLifetimeMatcher(true)
+
+	alloc := te.next("kmem_cache_alloc", 0x2000, 256)
+	free := te.next("kmem_cache_free", 0x2000, 0)
+	again := te.next("kmem_cache_free", 0x2000, 0)
+	lm.Add(alloc)
+	if lm.Add(free) != alloc {
+		t.Fatalf("free not paired with its allocation")
+	}
+	if lm.Add(again) != nil {
+		t.Errorf("second free paired with an allocation")
+	}
+	if len(lm.doubleFrees) != 1 || lm.doubleFrees[0].entry != again ||
+		lm.doubleFrees[0].previous != free {
+		t.Errorf("double frees %v, want the second free", lm.doubleFrees)
+	}
+	if lm.unknownFreeCount != 0 {
+		t.Errorf("double free counted as unknown free")
+	}
+}
+
+func TestLifetimeUnknownFree(t *testing.T) {
+	var te testEntries
+	lm := NewLifetimeMatcher(true)
+
+	free := te.next("kfree", 0x3000, 0)
+	if lm.Add(free) != nil {
+		t.Errorf("free of an unknown pointer paired with an allocation")
+	}
+	// kfree(NULL) is not an issue
+	lm.Add(te.next("kfree", 0, 0))
+	if len(lm.unknownFrees) != 1 || lm.unknownFrees[0] != free {
+		t.Errorf("unknown frees %v, want the free", lm.unknownFrees)
+	}
+	if lm.doubleFreeCount != 0 {
+		t.Errorf("unknown free counted as double free")
+	}
+}
+
+func TestLifetimeFreeMissed(t *testing.T) {
+	var te testEntries
+	lm := NewLifetimeMatcher(true)
+	lost := ftrace.NewLostEvents()
+
+	first := te.next("kmalloc", 0x4000, 64)
+	lost.Event(0, first.timestamp)
+	// the free of first is in the lost events
+	lost.Lost(0, 10)
+	second := te.next("kmalloc", 0x4000, 64)
+	lost.Event(0, second.timestamp)
+	free := te.next("kfree", 0x4000, 0)
+	unknown := te.next("kfree", 0x5000, 0)
+	for _, e := range []*MemEntry{first, second, free, unknown} {
+		lm.Add(e)
+	}
+
+	if !first.free_missed || len(lm.missedFrees) != 1 || lm.missedFrees[0] != first {
+		t.Errorf("allocation reused without a free not reported")
+	}
+	if second.free_missed || second.freeEntry != free {
+		t.Errorf("free after lost events not paired with the last allocation")
+	}
+	if unreliableText(lost, first) == "" {
+		t.Errorf("allocation before lost events not marked unreliable")
+	}
+	if unreliableText(lost, unknown) == "" {
+		t.Errorf("unknown free after lost events not marked unreliable")
+	}
+}
+
+func TestLifetimeCountOnly(t *testing.T) {
+	var te testEntries
+	lm := NewLifetimeMatcher(false)
+
+	lm.Add(te.next("kfree", 0x6000, 0))
+	lm.Add(te.next("kmalloc", 0x7000, 32))
+	lm.Add(te.next("kfree", 0x7000, 0))
+	lm.Add(te.next("kfree", 0x7000, 0))
+	if lm.unknownFreeCount != 1 || lm.doubleFreeCount != 1 {
+		t.Errorf("unknown frees %v double frees %v, want 1 and 1",
+			lm.unknownFreeCount, lm.doubleFreeCount)
+	}
+	if len(lm.unknownFrees) != 0 || len(lm.doubleFrees) != 0 {
+		t.Errorf("entries kept without keep")
+	}
+}
+
+func TestLifetimeMismatch(t *testing.T) {
+	var te testEntries
+	memEntries := NewMemEntries()
+	memEntries.lifetimes = NewLifetimeMatcher(true)
+
+	cacheAlloc := te.next("kmem_cache_alloc", 0x8000, 192)
+	kfree := te.next("kfree", 0x8000, 0)
+	nodeAlloc := te.next("kmalloc_node", 0x9000, 512)
+	cacheFree := te.next("kmem_cache_free", 0x9000, 0)
+	kmalloc := te.next("kmalloc", 0xa000, 64)
+	free := te.next("kfree", 0xa000, 0)
+	for _, e := range []*MemEntry{cacheAlloc, kfree, nodeAlloc, cacheFree, kmalloc, free} {
+		memEntries.Add(e)
+	}
+
+	lm := memEntries.lifetimes
+	if kfree.freeEntry != cacheAlloc || cacheFree.freeEntry != nodeAlloc {
+		t.Errorf("frees of another API not paired with their allocation")
+	}
+	if len(lm.mismatches) != 2 || lm.mismatches[0] != kfree || lm.mismatches[1] != cacheFree {
+		t.Errorf("mismatches %v, want the kfree and the kmem_cache_free", lm.mismatches)
+	}
+	if memEntries.freeSize != 192+512+64 || kfree.length != 192 {
+		t.Errorf("freed %v bytes, kfree of %v bytes", memEntries.freeSize, kfree.length)
+	}
+}
+
+func TestPageLifetimes(t *testing.T) {
+	var te testEntries
+	memEntries := NewMemEntries()
+	memEntries.lifetimes = NewLifetimeMatcher(true)
+	memEntries.pageLifetimes = NewLifetimeMatcher(true)
+
+	page := func(call_type string, pfn uint64) *MemEntry {
+		e := te.next(call_type, 0, 4096)
+		e.pfn = pfn
+		return e
+	}
+	alloc := page("mm_page_alloc", 0x100)
+	free := page("mm_page_free", 0x100)
+	batchAlloc := page("mm_page_alloc", 0x200)
+	batchFree := page("mm_page_free_batched", 0x200)
+	doubleFree := page("mm_page_free_batched", 0x200)
+	unknown := page("mm_page_free", 0x300)
+	failed := page("mm_page_alloc", noPfn)
+	leaked := page("mm_page_alloc", 0x400)
+	for _, e := range []*MemEntry{alloc, free, batchAlloc, batchFree,
+		doubleFree, unknown, failed, leaked} {
+		memEntries.Add(e)
+	}
+
+	pm := memEntries.pageLifetimes
+	if free.freeEntry != alloc || batchFree.freeEntry != batchAlloc {
+		t.Errorf("page frees not paired with their allocation by pfn")
+	}
+	if len(pm.doubleFrees) != 1 || pm.doubleFrees[0].entry != doubleFree {
+		t.Errorf("page double frees %v, want the second batched free", pm.doubleFrees)
+	}
+	if len(pm.unknownFrees) != 1 || pm.unknownFrees[0] != unknown {
+		t.Errorf("page unknown frees %v, want the free of pfn 0x300", pm.unknownFrees)
+	}
+	if len(pm.live) != 1 || pm.live[0x400] != leaked {
+		t.Errorf("outstanding pages %v, want pfn 0x400", pm.live)
+	}
+	if memEntries.lifetimes.unknownFreeCount != 0 {
+		t.Errorf("page frees paired as slab frees")
+	}
+	if memEntries.mm_page_alloc.count != 3 {
+		t.Errorf("page allocations %v, want 3 without the failed one",
+			memEntries.mm_page_alloc.count)
+	}
+}
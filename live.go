@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Mellanox/kmtracker/tracefs"
+)
+
+// LiveTracker keeps the alloc/free linking of a trace stream up to
+// date as entries arrive. Allocations are dropped once they are freed
+// and frees are not kept, double frees and other free issues are only
+// counted, so memory use follows the number of outstanding allocations
+// rather than the length of the trace.
+type LiveTracker struct {
+	mu         sync.Mutex
+	memEntries *MemEntrieByType
+	symbols    *KernelSymbols
+	// GroupByFunction, GroupBySite or GroupByModule
+	group string
+}
+
+func NewLiveTracker(symbols *KernelSymbols, group string) *LiveTracker {
+	lt := new(LiveTracker)
+	lt.memEntries = NewMemEntries()
+	lt.memEntries.lifetimes = NewLifetimeMatcher(false)
+	lt.symbols = symbols
+	lt.group = group
+	return lt
+}
+
+// Add accounts a single entry and links it when it is a free.
+func (lt *LiveTracker) Add(memEntry *MemEntry) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if isPageEvent(memEntry.call_type) {
+		// the live table shows slab allocations only
+		return
+	}
+	if lt.symbols != nil && memEntry.call_site != 0 {
+		resolveCallSite(lt.symbols, memEntry)
+	}
+
+	memEntries := lt.memEntries
+	if tracker := memEntries.freeTracker(memEntry.call_type); tracker != nil {
+		// frees are not kept, they only release their allocation
+		tracker.count++
+		if alloc := memEntries.lifetimes.Add(memEntry); alloc != nil {
+			memEntries.accountFree(memEntry, alloc)
+		}
+		return
+	}
+	memEntries.AddEntry(memEntry)
+	memEntries.lifetimes.Add(memEntry)
+}
+
+// Outstanding returns the outstanding allocations per call site,
+// function or module sorted by bytes.
+func (lt *LiveTracker) Outstanding() []*callSiteUsage {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	trackers := []*MemEntryTracker{&lt.memEntries.kmalloc,
+		&lt.memEntries.kmalloc_node, &lt.memEntries.kmem_cache_alloc}
+	for _, tracker := range trackers {
+		compactEntries(tracker)
+	}
+	return groupOutstanding(trackers, lt.group)
+}
+
+func (lt *LiveTracker) Print(top int) {
+	usages := lt.Outstanding()
+
+	var total uint64
+	for _, usage := range usages {
+		total += usage.bytes
+	}
+
+	// clear screen and move cursor to top left
+	fmt.Print("\033[H\033[2J")
+	column := groupColumn(lt.group)
+	fmt.Printf("%s outstanding = %v bytes in %v %ss\n\n",
+		time.Now().Format("15:04:05"), total, len(usages), column)
+	fmt.Printf("%12s %10s  %s\n", "bytes", "objects", column)
+	for i, usage := range usages {
+		if top > 0 && i >= top {
+			break
+		}
+		fmt.Printf("%12v %10v  %s\n", usage.bytes, usage.count, usage.name)
+	}
+}
+
+func runLive(args []string) error {
+	fs := flag.NewFlagSet("live", flag.ExitOnError)
+	pid := fs.Int("pid", -1, "pid whose memory allocations to be tracked, all when not set")
+	pipe := fs.String("pipe", "", "trace pipe or fifo to read, tracefs trace_pipe when not set")
+	interval := fs.Duration("interval", 5*time.Second, "refresh interval")
+	top := fs.Int("top", 20, "number of call sites to show, 0 shows all")
+	kernelfile := fs.String("vmlinux", "", "vmlinux file for kernel symbol lengths")
+	group := fs.String("group", GroupByFunction, "group allocations by function, call site or module")
+	var moduleDirs dirList
+	fs.Var(&moduleDirs, "modules", "directory of built modules searched before /lib/modules, can be repeated")
+	root := fs.String("tracefs", tracefs.DefaultRoot, "tracefs root directory")
+	fs.Parse(args)
+
+	if err := checkGroup(*group); err != nil {
+		return err
+	}
+	symbols, err := GetLiveKernelSymbolMap(*kernelfile, moduleDirs)
+	if err != nil {
+		fmt.Println("Fail to read kernel symbols, showing addresses:", err)
+		symbols = nil
+	}
+
+	path := *pipe
+	if len(path) == 0 {
+		// Enable the events ourselves when reading tracefs directly
+		// and restore the previous state on exit.
+		tc := &TraceControl{Root: *root}
+		state, err := tc.saveState("kmem")
+		if err != nil {
+			return err
+		}
+		defer tc.restoreState(state)
+
+		err = tc.Start([]string{"kmem:*"}, *pid, nil)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(*root, "trace_pipe")
+	}
+
+	file, err := OpenTrace(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lt := NewLiveTracker(symbols, *group)
+	done := make(chan error, 1)
+	go func() {
+		scanner := NewTraceScanner(file, int32(*pid), LoadTraceSchema("", *root))
+		for scanner.Scan() {
+			lt.Add(scanner.Entry())
+		}
+		done <- scanner.Err()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			lt.Print(*top)
+		case <-sig:
+			lt.Print(*top)
+			return nil
+		case err = <-done:
+			lt.Print(*top)
+			return err
+		}
+	}
+}
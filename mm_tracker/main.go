@@ -42,7 +42,7 @@ func main() {
 			return
 		}
 		if verbose == true {
-			ksyms.tree.BstTreePrint()
+			ksyms.IndexPrint()
 		}
 	}
 }
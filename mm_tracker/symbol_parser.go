@@ -3,8 +3,14 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/Mellanox/kmtracker/elfsym"
+	"github.com/Mellanox/kmtracker/modpath"
+	"github.com/Mellanox/kmtracker/symindex"
+	"github.com/Mellanox/kmtracker/symsnap"
 )
 
 type Symbol struct {
@@ -13,8 +19,8 @@ type Symbol struct {
 	StartAddress uint64 // updated from /proc/kallsyms
 	EndAddress   uint64 // updated from <module>.ko
 	Length       uint64
-	Left      *Symbol
-	Right     *Symbol
+	// length derived from the address of the next symbol
+	Estimated bool
 }
 
 type ModuleSymbols struct {
@@ -25,7 +31,41 @@ type ModuleSymbols struct {
 
 type KernelSymbols struct {
 	ModulesSymbols map[string]*ModuleSymbols
-	tree           BstTree
+	// address ranges of all symbols with a known length
+	index *symindex.Index
+	// module name to .ko file
+	modules *modpath.Resolver
+}
+
+// BuildIndex indexes the symbols by address once their lengths are
+// known.
+func (symbols *KernelSymbols) BuildIndex() {
+	var ranges []symindex.Range
+
+	for _, modSymbols := range symbols.ModulesSymbols {
+		for _, sym := range modSymbols.Symbols {
+			if sym.Length == 0 {
+				continue
+			}
+			ranges = append(ranges, symindex.Range{Start: sym.StartAddress,
+				End: sym.EndAddress, Name: sym.Name, Module: sym.Module,
+				Estimated: sym.Estimated})
+		}
+	}
+	symbols.index = symindex.New(ranges)
+}
+
+// SymbolFind returns the symbol range containing addr, nil if none.
+func (symbols *KernelSymbols) SymbolFind(addr uint64) *symindex.Range {
+	return symbols.index.Lookup(addr)
+}
+
+// IndexPrint prints the indexed symbols in address order.
+func (symbols *KernelSymbols) IndexPrint() {
+	for _, r := range symbols.index.Ranges() {
+		fmt.Printf("name=%v module=%v addr=%x len=%v\n",
+			r.Name, r.Module, r.Start, r.Len())
+	}
 }
 
 // build module list from the kallsyms
@@ -56,7 +96,6 @@ func BuildKallsymsMap() (*KernelSymbols, error) {
 	lines := strings.Split(string(data), "\n")
 
 	symbols := new(KernelSymbols)
-	symbols.tree.Root = nil
 
 	symbols.ModulesSymbols = make(map[string]*ModuleSymbols)
 
@@ -109,74 +148,76 @@ func BuildKallsymsMap() (*KernelSymbols, error) {
 	return symbols, nil
 }
 
-func GetModuleKoFileName(module_name string) (string, error) {
+// GetModuleSymbols returns the .symtab entries of a vmlinux or .ko
+// file.
+func GetModuleSymbols(module_file string) ([]elfsym.Symbol, error) {
 
-	cmdString := "modinfo " + module_name
+	file, err := modpath.Open(module_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	output := execShellCmdOutput(cmdString)
-	if len(output) == 0 {
-		return "", fmt.Errorf("Module not found")
+	symbols, err := elfsym.ReadSymbols(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", module_file, err)
 	}
-	lines := strings.Split(output, "\n")
-	line0 := strings.Trim(lines[0], "filename:")
-	line0 = strings.TrimLeft(line0, " ")
-	return string(line0), nil
+	return symbols, nil
 }
 
 // GetModuleSymbolsLen
 // Returns map: key(text symbol name) -> value (length of the symbol)
+// read from the .symtab of a vmlinux or .ko file.
 func GetModuleSymbolsLen(module_file string) (map[string]uint64, error) {
 
-	//fmt.Println(module_file)
-
-	objdumpSymbols := make(map[string]uint64)
-	cmdString := "objdump -t " + module_file
-
-	output := execShellCmdOutput(cmdString)
-	if len(output) == 0 {
-		return objdumpSymbols, fmt.Errorf("Module objdump error")
+	symbols, err := GetModuleSymbols(module_file)
+	if err != nil {
+		return make(map[string]uint64), err
 	}
-	lines := strings.Split(output, "\n")
-	//skip 4 lines
-	lines = lines[4:]
+	return elfsym.Sizes(symbols), nil
+}
 
-	for _, line := range lines {
+// relocate_module_symbols sets the length of the kallsyms symbols of a
+// module from its .ko symbols relocated with the section addresses of
+// /sys/module/<name>/sections, and adds the ones missing in kallsyms
+// such as .init.text functions. It returns the count of updated and
+// added symbols.
+func relocate_module_symbols(modSymbols *ModuleSymbols, module string,
+	moduleSymbols []elfsym.Symbol) (int, int) {
+	var update_cnt, add_cnt int
 
-		line = strings.Replace(line, "\t", " ", -1)
-		if strings.Contains(line, ".text..refcount") {
-			continue
-		}
-
-		if strings.Contains(line, ".init.text") ||
-			strings.Contains(line, ".exit.text") ||
-			strings.Contains(line, ".text") {
-			words := strings.Split(line, " ")
-
-			filtered_entry := make([]string, 6)
-			cnt := 0
-			for _, word := range words {
-				if len(word) == 0 || word == " " {
-					continue
-				}
-				filtered_entry[cnt] = word
-				cnt++
-			}
-			symLen, err := strconv.ParseUint(filtered_entry[4], 16, 64)
-			if err != nil {
-				continue
+	sections, err := symsnap.ReadSections(module)
+	if err != nil {
+		return 0, 0
+	}
+	byAddress := make(map[uint64]*Symbol)
+	for _, ksym := range modSymbols.Symbols {
+		byAddress[ksym.StartAddress] = ksym
+	}
+	for _, rsym := range elfsym.Relocate(moduleSymbols, sections) {
+		ksym := byAddress[rsym.Value]
+		if ksym != nil {
+			if ksym.EndAddress == 0 {
+				ksym.EndAddress = ksym.StartAddress + rsym.Size - 1
+				ksym.Length = rsym.Size
+				update_cnt++
 			}
-			objdumpSymbols[filtered_entry[5]] = symLen
+			continue
 		}
+		ksym = &Symbol{Name: rsym.Name, Module: module,
+			StartAddress: rsym.Value,
+			EndAddress:   rsym.Value + rsym.Size - 1, Length: rsym.Size}
+		modSymbols.Symbols[fmt.Sprintf("%016x", rsym.Value)] = ksym
+		byAddress[rsym.Value] = ksym
+		add_cnt++
 	}
-
-	return objdumpSymbols, nil
+	return update_cnt, add_cnt
 }
 
 func update_modules_symbols_len(symbols *KernelSymbols) error {
-	var objdumpSymbols map[string]uint64
-	var err2 error
+	var elfSymbols map[string]uint64
 	var total_update_cnt int
-	var update_cnt int
+	var total_add_cnt int
 
 	fmt.Println("Updating modules symbols length")
 
@@ -184,41 +225,46 @@ func update_modules_symbols_len(symbols *KernelSymbols) error {
 		if k == "linux_kernel" {
 			continue
 		}
-		file, err := GetModuleKoFileName(k)
-		if err != nil {
+		file, ok := symbols.modules.Find(k)
+		if !ok {
 			continue
 		}
-		objdumpSymbols, err2 = GetModuleSymbolsLen(file)
+		moduleSymbols, err2 := GetModuleSymbols(file)
 		if err2 != nil {
-			return err2
+			fmt.Println("Fail to read module symbols:", err2)
+			continue
 		}
-		update_cnt = 0
+		update_cnt, add_cnt := relocate_module_symbols(symbols.ModulesSymbols[k],
+			k, moduleSymbols)
+		total_update_cnt += update_cnt
+		total_add_cnt += add_cnt
+
+		elfSymbols = elfsym.Sizes(moduleSymbols)
 		for _, ksym := range symbols.ModulesSymbols[k].Symbols {
 			if ksym.EndAddress != 0 {
 				continue
 			}
-			for name, lensym := range objdumpSymbols {
-				if ksym.Name == name && k == ksym.Module {
-					ksym.EndAddress = ksym.StartAddress + lensym - 1
-					ksym.Length = lensym
-					//fmt.Println("name = ", ksym.Name)
-					update_cnt++
-					total_update_cnt++
-					symbols.tree.BstNodeInsert(ksym)
-				}
+			lensym := elfSymbols[ksym.Name]
+			if lensym == 0 || k != ksym.Module {
+				continue
 			}
+			ksym.EndAddress = ksym.StartAddress + lensym - 1
+			ksym.Length = lensym
+			update_cnt++
+			total_update_cnt++
 		}
 		//fmt.Printf("module %v = symbols resolved = %d\n",
 		//		k, update_cnt)
 	}
 	fmt.Printf("\tTotal update cnt for modules = %d\n", total_update_cnt)
+	fmt.Printf("\tTotal relocated symbols added for modules = %d\n", total_add_cnt)
 	fmt.Println("Updating modules symbols length done")
 	return nil
 }
 
 func update_kernel_symbols_len(kernel_file string,
 	kallsyms_map *ModuleSymbols) error {
-	var objdumpSymbols map[string]uint64
+	var elfSymbols map[string]uint64
 	var total_kernel_update_cnt int
 	var err3 error
 
@@ -228,7 +274,7 @@ func update_kernel_symbols_len(kernel_file string,
 	}
 
 	fmt.Println("Updating kernel symbols length")
-	objdumpSymbols, err3 = GetModuleSymbolsLen(kernel_file)
+	elfSymbols, err3 = GetModuleSymbolsLen(kernel_file)
 	if err3 != nil {
 		return err3
 	}
@@ -236,8 +282,9 @@ func update_kernel_symbols_len(kernel_file string,
 		if ksym.EndAddress != 0 {
 			continue
 		}
-		if objdumpSymbols[ksym.Name] != 0 {
-			ksym.EndAddress = ksym.StartAddress + objdumpSymbols[ksym.Name] - 1
+		if elfSymbols[ksym.Name] != 0 {
+			ksym.EndAddress = ksym.StartAddress + elfSymbols[ksym.Name] - 1
+			ksym.Length = elfSymbols[ksym.Name]
 			total_kernel_update_cnt++
 		}
 	}
@@ -246,6 +293,46 @@ func update_kernel_symbols_len(kernel_file string,
 	return nil
 }
 
+// estimate_symbols_len sets the end of the symbols whose length is
+// still unknown to the address before the next symbol of the same
+// module, so that call sites resolve with only /proc/kallsyms.
+func estimate_symbols_len(symbols *KernelSymbols) {
+	var total_estimate_cnt int
+
+	fmt.Println("Estimating symbols length from kallsyms")
+	for _, modSymbols := range symbols.ModulesSymbols {
+		sorted := make([]*Symbol, 0, len(modSymbols.Symbols))
+		for _, sym := range modSymbols.Symbols {
+			sorted = append(sorted, sym)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].StartAddress < sorted[j].StartAddress
+		})
+
+		for i, sym := range sorted {
+			if sym.EndAddress != 0 {
+				continue
+			}
+			// aliases share the address, the next one is further
+			next := i + 1
+			for next < len(sorted) &&
+				sorted[next].StartAddress == sym.StartAddress {
+				next++
+			}
+			if next == len(sorted) {
+				// last symbol of the module, its end is unknown
+				continue
+			}
+			sym.EndAddress = sorted[next].StartAddress - 1
+			sym.Length = sym.EndAddress - sym.StartAddress + 1
+			sym.Estimated = true
+			total_estimate_cnt++
+		}
+	}
+	fmt.Printf("\tTotal estimated symbols = %d\n", total_estimate_cnt)
+	fmt.Println("Estimating symbols length done")
+}
+
 func GetLiveKernelSymbolMap(kernel_file string) (*KernelSymbols, error) {
 
 	fmt.Println("Building kallsyms map")
@@ -259,11 +346,18 @@ func GetLiveKernelSymbolMap(kernel_file string) (*KernelSymbols, error) {
 	// map: key->value,
 	//      key: kernel module(driver) name
 	//      value: is count of symbols that belong to that object.
+	symbols.modules = modpath.New()
+	err = symbols.modules.Add(modpath.Dir(modpath.Release()))
+	if err != nil {
+		fmt.Println("Fail to read modules:", err)
+	}
 	fmt.Println("Building modules list done")
 
 	update_modules_symbols_len(symbols)
 	update_kernel_symbols_len(kernel_file,
 		symbols.ModulesSymbols["linux_kernel"])
+	estimate_symbols_len(symbols)
+	symbols.BuildIndex()
 
 	return symbols, nil
 }
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"strconv"
-	"strings"
+	"os"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+	"github.com/Mellanox/kmtracker/slabwaste"
+	"github.com/Mellanox/kmtracker/tracefs"
 )
 
 type MemEntry struct {
+	comm      string
+	pid       int32
+	tgid      int32
+	cpu       int
+	flags     ftrace.Flags
+	timestamp float64 // seconds
+
 	call_type string
 	order     uint64
 	pfn       uint64 /* useful only for mm */
@@ -16,6 +28,8 @@ type MemEntry struct {
 	bytes_requested uint64
 	bytes_allocated uint64
 	ptr             uint64
+	gfp_flags       string
+	node            int /* -1 when not known */
 	/* kmalloc/free friends end */
 
 	call_site   string
@@ -28,7 +42,6 @@ type MemEntry struct {
 type PfnTracker struct {
 	alloc_bytes uint64
 	free_bytes  uint64
-	entries     []*MemEntry
 	pfnmap      map[uint64]*MemEntry
 	/* if alloc-free is balanced, moved to balanced map
 	 * so that when pfn is reallocated its free can be tracked
@@ -40,58 +53,15 @@ type PfnTracker struct {
 type KmemTracker struct {
 	alloc_bytes uint64
 	free_bytes  uint64
-	entries     []*MemEntry
 	kmemmap     map[uint64]*MemEntry /* allocated addr to entry map */
 }
 
-func get_uint64_value_of_key(kv string, key string, base int) (uint64, error) {
-	if strings.Contains(kv, key) == false {
-		return 0, fmt.Errorf("invalid string", kv)
-	}
-
-	parts := strings.Split(kv, "=")
-	if len(parts) == 1 || len(parts[1]) == 0 {
-		return 0, fmt.Errorf("null value")
-	}
-
-	value, err2 := strconv.ParseUint(parts[1], base, 64)
-	if err2 != nil {
-		return 0, err2
-	}
-	return value, nil
-}
-
-func get_string_value_of_key(kv string, key string) (string, error) {
-	if strings.Contains(kv, key) == false {
-		return "", fmt.Errorf("invalid string", kv)
-	}
-
-	parts := strings.Split(kv, "=")
-	if len(parts) == 1 || len(parts[1]) == 0 {
-		return "", fmt.Errorf("null value")
-	}
-	return parts[1], nil
-}
-
-func get_mm_order(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "order=", 10)
-	return value, err
-}
-
-func get_mm_pfn(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "pfn=", 10)
-	return value, err
-}
-
-func decode_pfn_order(entry *MemEntry, valid_kv []string) error {
-	//fmt.Printf("%s %s\n", valid_kv[2], valid_kv[3])
-	pfn, pfn_err := get_mm_pfn(valid_kv[2])
+func decode_pfn_order(entry *MemEntry, event *ftrace.Event) error {
+	pfn, pfn_err := event.Uint("pfn")
 	if pfn_err != nil {
 		return pfn_err
 	}
-	order, order_err := get_mm_order(valid_kv[3])
+	order, order_err := event.Uint("order")
 	if order_err != nil {
 		return order_err
 	}
@@ -100,116 +70,193 @@ func decode_pfn_order(entry *MemEntry, valid_kv []string) error {
 	return nil
 }
 
-func get_req_bytes(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "bytes_req=", 10)
-	return value, err
-}
-
-func get_alloc_bytes(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "bytes_alloc=", 10)
-	return value, err
-}
-
-func get_mem_ptr(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "ptr=", 16)
-	return value, err
-}
-
-func decode_alloc(entry *MemEntry, valid_kv []string) error {
-	mem_ptr, err := get_mem_ptr(valid_kv[2])
+func decode_alloc(entry *MemEntry, event *ftrace.Event) error {
+	mem_ptr, err := event.Uint("ptr")
 	if err != nil {
 		return err
 	}
-	bytes_req, req_err := get_req_bytes(valid_kv[3])
+	bytes_req, req_err := event.Uint("bytes_req")
 	if req_err != nil {
 		return req_err
 	}
-	bytes_alloc, alloc_err := get_alloc_bytes(valid_kv[4])
+	bytes_alloc, alloc_err := event.Uint("bytes_alloc")
 	if alloc_err != nil {
 		return alloc_err
 	}
-	value, call_err := get_string_value_of_key(valid_kv[1], "call_site=")
-	if call_err != nil {
-		return call_err
+	if !event.Has("call_site") {
+		return fmt.Errorf("%s: call_site not found", event.Name)
 	}
-	entry.call_site = value
+	entry.call_site = event.String("call_site")
 	entry.ptr = mem_ptr
 	entry.bytes_requested = bytes_req
 	entry.bytes_allocated = bytes_alloc
+	entry.gfp_flags = event.String("gfp_flags")
+	entry.node = -1
+	if node, err := event.Int("node"); err == nil {
+		entry.node = int(node)
+	}
 	return nil
 }
 
-func decode_free(entry *MemEntry, valid_kv []string) error {
-	free_ptr, err := get_mem_ptr(valid_kv[2])
+func decode_free(entry *MemEntry, event *ftrace.Event) error {
+	free_ptr, err := event.Uint("ptr")
 	if err != nil {
 		return err
 	}
-	value, call_err := get_string_value_of_key(valid_kv[1], "call_site=")
-	if call_err != nil {
-		return call_err
+	if !event.Has("call_site") {
+		return fmt.Errorf("%s: call_site not found", event.Name)
 	}
-	entry.call_site = value
+	entry.call_site = event.String("call_site")
 	entry.ptr = free_ptr
 	return nil
 }
 
-func parseLine(line string, line_number int) (*MemEntry, error) {
-
-	line = strings.TrimLeft(line, " ")
-	if len(line) == 0 {
-		return nil, fmt.Errorf("short line")
-	}
-
-	words := strings.Split(line, " ")
+// requiredFields are the event fields mm_tracker depends on.
+var requiredFields = map[string][]string{
+	"kmalloc":          {"call_site", "ptr", "bytes_req", "bytes_alloc"},
+	"kmalloc_node":     {"call_site", "ptr", "bytes_req", "bytes_alloc"},
+	"kmem_cache_alloc": {"call_site", "ptr", "bytes_req", "bytes_alloc"},
+	"kfree":            {"call_site", "ptr"},
+	"kmem_cache_free":  {"call_site", "ptr"},
+	"mm_page_alloc":    {"pfn", "order"},
+	"mm_page_free":     {"pfn", "order"},
+}
 
-	valid_kv := make([]string, 0)
+func parseLine(line string, line_number int, parser *ftrace.FieldParser,
+	lost *ftrace.LostEvents) (*MemEntry, *ftrace.Event, error) {
 
-	for _, word := range words {
-		if len(word) == 0 || word == " " || word == "(null)" {
-			continue
-		}
-		//fmt.Println(valid_kv)
-		valid_kv = append(valid_kv, word)
-	}
-	if len(valid_kv) < 4 {
-		return nil, fmt.Errorf("short line")
+	prefix, body, err := ftrace.ParsePrefix(line)
+	if err != nil {
+		return nil, nil, err
 	}
+	lost.Event(prefix.CPU, prefix.Timestamp)
 
-	//remove pid, cpu, state, time
-	valid_kv = valid_kv[4:]
-	//fmt.Println(pid, len(valid_kv), valid_kv)
+	event, err := parser.ParseEvent(body)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	memEntry := new(MemEntry)
+	memEntry.comm = prefix.Comm
+	memEntry.pid = prefix.Pid
+	memEntry.tgid = prefix.Tgid
+	memEntry.cpu = prefix.CPU
+	memEntry.flags = prefix.Flags
+	memEntry.timestamp = prefix.Timestamp
 	memEntry.line_number = line_number
 	memEntry.line = line
-	memEntry.call_type = strings.TrimRight(valid_kv[0], ":")
-	//fmt.Printf("%s ", memEntry.call_type)
+	memEntry.call_type = event.Name
 
 	switch memEntry.call_type {
 	case "mm_page_alloc", "mm_page_alloc_zone_locked", "mm_page_free", "mm_page_free_batched":
-		err := decode_pfn_order(memEntry, valid_kv)
+		err := decode_pfn_order(memEntry, event)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	case "kmem_cache_alloc", "kmalloc_node", "kmalloc":
-		err := decode_alloc(memEntry, valid_kv)
+		err := decode_alloc(memEntry, event)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	case "kmem_cache_free", "kfree":
-		err := decode_free(memEntry, valid_kv)
+		err := decode_free(memEntry, event)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	return memEntry, nil
+	return memEntry, event, nil
 }
 
-func order_to_bytes(order uint64) uint64 {
-	return (order + 1) * 4096
+// TraceScanner reads a text trace line by line and emits one MemEntry
+// at a time, so that only outstanding allocations are kept in memory.
+type TraceScanner struct {
+	scanner     *bufio.Scanner
+	parser      *ftrace.FieldParser
+	line_number int
+	entry       *MemEntry
+	header      ftrace.Header
+	lost        *ftrace.LostEvents
+
+	schema   *tracefs.Schema /* nil when formats are not available */
+	checked  map[string]bool
+	warnings []string
+}
+
+func NewTraceScanner(r io.Reader, schema *tracefs.Schema) *TraceScanner {
+	var formats map[string]*ftrace.EventFormat
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if schema != nil {
+		formats = schema.Events
+	}
+	return &TraceScanner{scanner: scanner, schema: schema,
+		parser:  ftrace.NewFieldParser(formats),
+		lost:    ftrace.NewLostEvents(),
+		checked: make(map[string]bool)}
+}
+
+func (ts *TraceScanner) Scan() bool {
+	for ts.scanner.Scan() {
+		ts.line_number++
+		if cpu, count, ok := ftrace.ParseLostLine(ts.scanner.Text()); ok {
+			ts.lost.Lost(cpu, count)
+			continue
+		}
+		if ts.header.ParseLine(ts.scanner.Text()) {
+			continue
+		}
+		entry, event, err := parseLine(ts.scanner.Text(), ts.line_number, ts.parser, ts.lost)
+		if err != nil {
+			continue
+		}
+		if ts.schema != nil && !ts.checked[event.Name] {
+			ts.checked[event.Name] = true
+			if err := ts.schema.CheckEvent(event); err != nil {
+				ts.warnings = append(ts.warnings, err.Error())
+			}
+		}
+		ts.entry = entry
+		return true
+	}
+	ts.entry = nil
+	return false
+}
+
+func (ts *TraceScanner) Entry() *MemEntry {
+	return ts.entry
+}
+
+func (ts *TraceScanner) Header() *ftrace.Header {
+	return &ts.header
+}
+
+func (ts *TraceScanner) Lost() *ftrace.LostEvents {
+	return ts.lost
+}
+
+func (ts *TraceScanner) Warnings() []string {
+	return ts.warnings
+}
+
+func (ts *TraceScanner) Err() error {
+	return ts.scanner.Err()
+}
+
+// order_to_bytes converts a page order to bytes with the page size of
+// the traced kernel, as kmtracker does.
+func order_to_bytes(order uint64, pageSize int) uint64 {
+	return uint64(pageSize) << order
+}
+
+// printNotFreed prints an allocation without free, marking it when a
+// window of lost events after it may hide its free.
+func printNotFreed(entry *MemEntry, lost *ftrace.LostEvents) {
+	if w := lost.WindowAfter(entry.timestamp); w != nil {
+		fmt.Printf("%v (unreliable, %v)\n", entry.line, w)
+		return
+	}
+	fmt.Printf("%v\n", entry.line)
 }
 
 func parse_mm_entries(trace_file string, verbose bool) (*KmemTracker, *PfnTracker) {
@@ -219,45 +266,76 @@ func parse_mm_entries(trace_file string, verbose bool) (*KmemTracker, *PfnTracke
 	kmem_tracker := new(KmemTracker)
 	kmem_tracker.kmemmap = make(map[uint64]*MemEntry)
 
-	data, err := ioutil.ReadFile(trace_file)
-	if err != nil {
-		return nil, nil
-	}
+	waste := slabwaste.New()
 
-	lines := strings.Split(string(data), "\n")
-	//skip first 11 lines
-	offset := 11
-	lines = lines[offset:]
+	var file io.ReadCloser
+	var err error
 
-	for i, line := range lines {
-		entry, err := parseLine(line, i+offset+1)
+	if trace_file == "-" {
+		file = ioutil.NopCloser(os.Stdin)
+	} else {
+		file, err = os.Open(trace_file)
 		if err != nil {
-			continue
+			return nil, nil
+		}
+	}
+	defer file.Close()
+
+	schema, err := tracefs.LoadSchema(tracefs.DefaultRoot, "kmem")
+	if err != nil {
+		fmt.Println("Warning: event formats not found, trace fields are not validated")
+		schema = nil
+	} else {
+		for _, warning := range schema.CheckFields(requiredFields) {
+			fmt.Println("Warning:", warning)
 		}
+	}
+
+	pageSize := tracefs.DefaultPageSize
+	if schema != nil {
+		pageSize = schema.PageSize
+	}
+
+	scanner := NewTraceScanner(file, schema)
+	for scanner.Scan() {
+		entry := scanner.Entry()
 
 		switch entry.call_type {
 		case "mm_page_alloc", "mm_page_alloc_zone_locked":
-			pfn_tracker.entries = append(pfn_tracker.entries, entry)
 			pfn_tracker.pfnmap[entry.pfn] = entry
-			pfn_tracker.alloc_bytes += order_to_bytes(entry.order)
+			pfn_tracker.alloc_bytes += order_to_bytes(entry.order, pageSize)
 		case "mm_page_free", "mm_page_free_batched":
-			pfn_tracker.entries = append(pfn_tracker.entries, entry)
 			if pfn_tracker.pfnmap[entry.pfn] != nil {
-				pfn_tracker.free_bytes += order_to_bytes(entry.order)
-				pfn_tracker.pfnmap[entry.pfn] = nil
+				pfn_tracker.free_bytes += order_to_bytes(entry.order, pageSize)
+				delete(pfn_tracker.pfnmap, entry.pfn)
 			}
 		case "kmem_cache_alloc", "kmalloc_node", "kmalloc":
-			kmem_tracker.entries = append(kmem_tracker.entries, entry)
 			kmem_tracker.alloc_bytes += entry.bytes_allocated
 			kmem_tracker.kmemmap[entry.ptr] = entry
+			waste.Add(entry.call_site, entry.call_type != "kmem_cache_alloc",
+				entry.bytes_requested, entry.bytes_allocated)
 		case "kmem_cache_free", "kfree":
-			kmem_tracker.entries = append(kmem_tracker.entries, entry)
 			if kmem_tracker.kmemmap[entry.ptr] != nil {
 				kmem_tracker.free_bytes += kmem_tracker.kmemmap[entry.ptr].bytes_allocated
-				kmem_tracker.kmemmap[entry.ptr] = nil
+				delete(kmem_tracker.kmemmap, entry.ptr)
 			}
 		}
 	}
+	if scanner.Err() != nil {
+		return nil, nil
+	}
+	fmt.Println("Trace options:", scanner.Header())
+	for _, warning := range scanner.Warnings() {
+		fmt.Println("Warning:", warning)
+	}
+	lost := scanner.Lost()
+	if len(lost.Windows) != 0 {
+		lost.Sort()
+		fmt.Println("Warning: the trace is incomplete, events were lost")
+		for _, w := range lost.Windows {
+			fmt.Println("\t" + w.String())
+		}
+	}
 	fmt.Printf("page alloc bytes = %d = %d Kbytes = %d Mbytes\n", pfn_tracker.alloc_bytes,
 		pfn_tracker.alloc_bytes/1024, pfn_tracker.alloc_bytes/(1024*1024))
 	fmt.Printf("page free bytes = %d = %d Kbytes = %d Mbytes\n", pfn_tracker.free_bytes,
@@ -266,6 +344,7 @@ func parse_mm_entries(trace_file string, verbose bool) (*KmemTracker, *PfnTracke
 		kmem_tracker.alloc_bytes/1024, kmem_tracker.alloc_bytes/(1024*1024))
 	fmt.Printf("kmem free bytes = %d = %d Kbytes = %d Mbytes\n", kmem_tracker.free_bytes,
 		kmem_tracker.free_bytes/1024, kmem_tracker.free_bytes/(1024*1024))
+	waste.Print("call site", 0)
 
 	if verbose {
 		var bytes_not_freed uint64
@@ -275,19 +354,19 @@ func parse_mm_entries(trace_file string, verbose bool) (*KmemTracker, *PfnTracke
 				continue
 			}
 			bytes_not_freed += element.bytes_allocated
-			fmt.Printf("%v\n", element.line)
+			printNotFreed(element, lost)
 		}
-		fmt.Printf("kmem bytes not freed = %v\n", bytes_not_freed);
+		fmt.Printf("kmem bytes not freed = %v\n", bytes_not_freed)
 
 		bytes_not_freed = 0
 		for _, element := range pfn_tracker.pfnmap {
 			if element == nil {
 				continue
 			}
-			bytes_not_freed += element.bytes_allocated
-			fmt.Printf("%v\n", element.line)
+			bytes_not_freed += order_to_bytes(element.order, pageSize)
+			printNotFreed(element, lost)
 		}
-		fmt.Printf("pages bytes not freed = %v\n", bytes_not_freed);
+		fmt.Printf("pages bytes not freed = %v\n", bytes_not_freed)
 	}
 	return kmem_tracker, pfn_tracker
 }
@@ -0,0 +1,109 @@
+package modpath
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// File is the content of a module file, decompressed.
+type File interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// Decompressors of compressed module files. gzip is read in process,
+// xz and zstd need their tools installed.
+var decompressors = map[string][]string{
+	".xz":  {"xz", "-dc"},
+	".zst": {"zstd", "-dcq"},
+}
+
+// MissingToolError is returned by Open for a module compressed with a
+// format whose decompression tool is not installed.
+type MissingToolError struct {
+	Tool string
+	Path string
+}
+
+func (e *MissingToolError) Error() string {
+	return fmt.Sprintf("%s: %s is not installed, it is needed to decompress the module",
+		e.Path, e.Tool)
+}
+
+// Uncompressed returns path without the compression extension of a
+// module file, x.ko for x.ko.xz.
+func Uncompressed(path string) string {
+	for _, ext := range []string{".gz", ".xz", ".zst"} {
+		if strings.HasSuffix(path, ".ko"+ext) {
+			return strings.TrimSuffix(path, ext)
+		}
+	}
+	return path
+}
+
+// Open opens a vmlinux or module file. Compressed modules, .ko.gz,
+// .ko.xz and .ko.zst, are decompressed in memory.
+func Open(path string) (File, error) {
+	if Uncompressed(path) == path {
+		return os.Open(path)
+	}
+	data, err := decompress(path)
+	if _, ok := err.(*MissingToolError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+func decompress(path string) ([]byte, error) {
+	if strings.HasSuffix(path, ".gz") {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	}
+
+	for ext, tool := range decompressors {
+		if !strings.HasSuffix(path, ext) {
+			continue
+		}
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			return nil, &MissingToolError{Tool: tool[0], Path: path}
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(tool[0], append(tool[1:], path)...)
+		cmd.Stderr = &stderr
+		data, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+				return nil, fmt.Errorf("%s: %v: %s", tool[0], err, msg)
+			}
+			return nil, fmt.Errorf("%s: %v", tool[0], err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown compression")
+}
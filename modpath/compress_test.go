@@ -0,0 +1,47 @@
+package modpath
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("\x7fELF module"))
+	zw.Close()
+	path := filepath.Join(t.TempDir(), "mlx5_core.ko.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data := make([]byte, 11)
+	if _, err := file.ReadAt(data, 0); err != nil || string(data) != "\x7fELF module" {
+		t.Errorf("decompressed %q %v", data, err)
+	}
+}
+
+func TestOpenMissingTool(t *testing.T) {
+	dir := t.TempDir()
+	// no xz or zstd in an empty PATH
+	t.Setenv("PATH", dir)
+	for ext, tool := range map[string]string{".xz": "xz", ".zst": "zstd"} {
+		path := filepath.Join(dir, "mlx5_core.ko"+ext)
+		if err := os.WriteFile(path, []byte("compressed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Open(path)
+		missing, ok := err.(*MissingToolError)
+		if !ok || missing.Tool != tool || missing.Path != path {
+			t.Errorf("%s: error %v, want %s missing", path, err, tool)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package modpath finds the .ko file of a kernel module by its name in
+// /lib/modules/<release> or in directory trees of built modules.
+package modpath
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ModulesRoot is where the modules of installed kernels are.
+var ModulesRoot = "/lib/modules"
+
+// Extensions of module files, compressed ones included.
+var Extensions = []string{".ko", ".ko.xz", ".ko.zst", ".ko.gz"}
+
+// Dir returns the module directory of a kernel release.
+func Dir(release string) string {
+	return filepath.Join(ModulesRoot, release)
+}
+
+// Release returns the release of the running kernel.
+func Release() string {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ModuleName returns the name of the module in file, the way kallsyms
+// shows it: without directory and extension and with - replaced by _.
+// It returns an empty string when file is not a module.
+func ModuleName(file string) string {
+	base := filepath.Base(file)
+	for _, ext := range Extensions {
+		if strings.HasSuffix(base, ext) {
+			return strings.Replace(strings.TrimSuffix(base, ext), "-", "_", -1)
+		}
+	}
+	return ""
+}
+
+// Resolver maps module names to files. Directories added first take
+// precedence, so a driver build tree added before /lib/modules wins over
+// the installed copy.
+type Resolver struct {
+	Dirs  []string
+	files map[string]string
+}
+
+func New() *Resolver {
+	return &Resolver{files: make(map[string]string)}
+}
+
+// Add indexes the modules of dir. modules.dep is used when dir has one,
+// otherwise the tree is walked.
+func (r *Resolver) Add(dir string) error {
+	r.Dirs = append(r.Dirs, dir)
+	err := r.readDep(dir)
+	if os.IsNotExist(err) {
+		err = r.walk(dir)
+	}
+	return err
+}
+
+func (r *Resolver) add(name string, path string) {
+	if _, ok := r.files[name]; !ok {
+		r.files[name] = path
+	}
+}
+
+// readDep reads modules.dep of dir, lines such as
+// "kernel/drivers/net/ethernet/mellanox/mlx5/core/mlx5_core.ko.xz: kernel/...".
+func (r *Resolver) readDep(dir string) error {
+	file, err := os.Open(filepath.Join(dir, "modules.dep"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		path := line[:colon]
+		name := ModuleName(path)
+		if len(name) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		r.add(name, path)
+	}
+	return scanner.Err()
+}
+
+func (r *Resolver) walk(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// unreadable subdirectory
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if name := ModuleName(path); len(name) != 0 {
+			r.add(name, path)
+		}
+		return nil
+	})
+}
+
+// Find returns the file of module name.
+func (r *Resolver) Find(name string) (string, bool) {
+	path, ok := r.files[strings.Replace(name, "-", "_", -1)]
+	return path, ok
+}
+
+// Len returns the number of modules known.
+func (r *Resolver) Len() int {
+	return len(r.files)
+}
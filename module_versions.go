@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+	"github.com/Mellanox/kmtracker/symindex"
+	"github.com/Mellanox/kmtracker/symsnap"
+)
+
+func isModuleEvent(name string) bool {
+	return name == "module_load" || name == "module_free"
+}
+
+// moduleLoad is one load of a module seen in the trace. load is -Inf
+// for a module loaded before the trace started and free is +Inf for a
+// module still loaded at its end.
+type moduleLoad struct {
+	load float64
+	free float64
+	// layout saved by record for this load, nil when not known
+	layout *symsnap.Layout
+	// symbols of this load, nil when its layout is not known
+	index *symindex.Index
+	// the load the symbol snapshot was taken of, resolved with the
+	// main symbol index
+	current bool
+}
+
+// address returns the load address of the module for this load, 0 when
+// it is not known.
+func (l *moduleLoad) address(snapshot *symsnap.Snapshot, name string) uint64 {
+	if l.layout != nil {
+		return l.layout.Module.Address
+	}
+	if l.current && snapshot != nil && snapshot.Modules[name] != nil {
+		return snapshot.Modules[name].Address
+	}
+	return 0
+}
+
+// ModuleTimeline holds the loads of the modules loaded or unloaded
+// while tracing, from the module_load and module_free events.
+type ModuleTimeline struct {
+	loads map[string][]*moduleLoad
+	// number of module events seen, it changes whenever a module
+	// address may start to name other symbols
+	events int
+}
+
+func NewModuleTimeline() *ModuleTimeline {
+	return &ModuleTimeline{loads: make(map[string][]*moduleLoad)}
+}
+
+// Event adds a module_load or module_free event at time ts.
+func (mt *ModuleTimeline) Event(event *ftrace.Event, ts float64) {
+	name := event.String("name")
+	if len(name) == 0 {
+		return
+	}
+	mt.events++
+	loads := mt.loads[name]
+	switch event.Name {
+	case "module_load":
+		mt.loads[name] = append(loads, &moduleLoad{load: ts, free: math.Inf(1)})
+	case "module_free":
+		if len(loads) == 0 || !math.IsInf(loads[len(loads)-1].free, 1) {
+			// loaded before the trace started
+			mt.loads[name] = append(loads, &moduleLoad{load: math.Inf(-1), free: ts})
+			return
+		}
+		loads[len(loads)-1].free = ts
+	}
+}
+
+// Len returns the number of modules loaded or unloaded while tracing.
+func (mt *ModuleTimeline) Len() int {
+	return len(mt.loads)
+}
+
+// loadAt returns the load of module name at time ts, nil when it was
+// not loaded.
+func (mt *ModuleTimeline) loadAt(name string, ts float64) *moduleLoad {
+	for _, l := range mt.loads[name] {
+		if l.load <= ts && ts < l.free {
+			return l
+		}
+	}
+	return nil
+}
+
+// layoutIndex builds the symbol index of a module layout saved while
+// tracing.
+func (symbols *KernelSymbols) layoutIndex(name string, layout *symsnap.Layout) *symindex.Index {
+	ksyms, _, _ := parseKallsyms(layout.Kallsyms)
+	modSymbols := ksyms.ModulesSymbols[name]
+	if modSymbols == nil {
+		return nil
+	}
+	if file, ok := symbols.modules.Find(name); ok {
+		_, _, err := update_module_symbols_len(modSymbols, name, file,
+			layout.Module.Sections)
+		if err != nil {
+			fmt.Println("Fail to read module symbols:", err)
+		}
+	}
+	estimate_module_symbols_len(modSymbols)
+	ksyms.BuildIndex()
+	return ksyms.index
+}
+
+// matchLayouts gives the loads of a module the layouts record saw.
+// A layout belongs to the load running at the time it was seen. Layouts
+// of snapshots without these times are only matched when there is one
+// for every load. It returns the layouts not matched.
+func matchLayouts(loads []*moduleLoad, layouts []*symsnap.Layout) []*symsnap.Layout {
+	var unmatched, untimed []*symsnap.Layout
+
+	for _, layout := range layouts {
+		if layout.Seen == 0 {
+			untimed = append(untimed, layout)
+			continue
+		}
+		// the last load started before the layout was seen, the load
+		// may have ended between reading /proc/modules and the clock
+		var match *moduleLoad
+		for _, l := range loads {
+			if l.load <= layout.Seen {
+				match = l
+			}
+		}
+		if match == nil || match.layout != nil {
+			unmatched = append(unmatched, layout)
+			continue
+		}
+		match.layout = layout
+	}
+	if len(untimed) != len(loads) {
+		return append(unmatched, untimed...)
+	}
+	for i, l := range loads {
+		if l.layout == nil {
+			l.layout = untimed[i]
+		}
+	}
+	return unmatched
+}
+
+// sameAddressLoad returns a load with known symbols for load i, which
+// has no layout, when the nearest loads before and after it with a
+// known address and the layouts not matched to any load are all at the
+// same address, so the module was reloaded where it was. It returns
+// nil when the address may have changed.
+func sameAddressLoad(loads []*moduleLoad, i int, unmatched []*symsnap.Layout,
+	snapshot *symsnap.Snapshot, name string) *moduleLoad {
+	var same *moduleLoad
+	var addr uint64
+
+	for j := i - 1; j >= 0; j-- {
+		if a := loads[j].address(snapshot, name); a != 0 {
+			same, addr = loads[j], a
+			break
+		}
+	}
+	for j := i + 1; j < len(loads); j++ {
+		a := loads[j].address(snapshot, name)
+		if a == 0 {
+			continue
+		}
+		if same != nil && a != addr {
+			return nil
+		}
+		if same == nil {
+			same, addr = loads[j], a
+		}
+		break
+	}
+	for _, layout := range unmatched {
+		if layout.Module.Address != addr {
+			return nil
+		}
+	}
+	return same
+}
+
+// SetModuleTimeline makes call sites resolve against the layout of
+// the modules at the time of each entry. Loads are matched with the
+// layouts record saw by time. The last load uses the symbols of the
+// snapshot when the module is still loaded. A load without a layout
+// uses the symbols of the loads around it when they are all at the same
+// address, otherwise its call sites are left unresolved rather than
+// resolved with symbols of another load.
+func (symbols *KernelSymbols) SetModuleTimeline(mt *ModuleTimeline) {
+	if mt == nil || mt.Len() == 0 {
+		return
+	}
+	symbols.timeline = mt
+
+	fmt.Println("Building symbols of reloaded modules")
+	for name, loads := range mt.loads {
+		var layouts []*symsnap.Layout
+		if symbols.snapshot != nil {
+			layouts = symbols.snapshot.LayoutsOf(name)
+		}
+		last := loads[len(loads)-1]
+		last.current = math.IsInf(last.free, 1) &&
+			symbols.ModulesSymbols[name] != nil
+
+		unmatched := matchLayouts(loads, layouts)
+		for _, l := range loads {
+			if !l.current && l.layout != nil {
+				l.index = symbols.layoutIndex(name, l.layout)
+			}
+		}
+		for i, l := range loads {
+			if l.current || l.layout != nil {
+				continue
+			}
+			same := sameAddressLoad(loads, i, unmatched, symbols.snapshot, name)
+			if same != nil {
+				l.current = same.current
+				l.index = same.index
+			}
+		}
+
+		known := 0
+		for _, l := range loads {
+			if l.current || l.index != nil {
+				known++
+			}
+		}
+		fmt.Printf("\tmodule %s: %d loads in the trace, %d with known symbols\n",
+			name, len(loads), known)
+	}
+	fmt.Println("Building symbols of reloaded modules done")
+}
+
+// symbolAt returns the symbol of addr at time ts. sym is the symbol of
+// the snapshot, it is only valid while the load it was taken of was
+// loaded.
+func (symbols *KernelSymbols) symbolAt(addr uint64, ts float64, sym *symindex.Range) *symindex.Range {
+	mt := symbols.timeline
+	if mt == nil {
+		return sym
+	}
+	for _, loads := range mt.loads {
+		for _, l := range loads {
+			if l.index == nil || ts < l.load || ts >= l.free {
+				continue
+			}
+			if r := l.index.Lookup(addr); r != nil {
+				return r
+			}
+		}
+	}
+	if sym == nil || len(mt.loads[sym.Module]) == 0 {
+		return sym
+	}
+	if l := mt.loadAt(sym.Module, ts); l == nil || !l.current {
+		return nil
+	}
+	return sym
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Mellanox/kmtracker/symsnap"
+	"github.com/Mellanox/kmtracker/tracefs"
+)
+
+// TraceControl drives the ftrace control files below a tracefs root.
+// Root is normally /sys/kernel/debug/tracing but can point to any
+// directory tree with the same layout.
+type TraceControl struct {
+	Root string
+}
+
+// traceState is the part of the tracing configuration that record
+// modifies and restores on exit.
+type traceState struct {
+	tracingOn   int
+	setEvent    string
+	setEventPid string
+	// event system to the content of its filter file
+	filters map[string]string
+	// event, as system:event, to the content of its filter file
+	eventFilters map[string]string
+	// events record added a stacktrace trigger to
+	stackEvents []string
+}
+
+// moduleEvents are traced for all processes, modules are loaded by
+// modprobe or insmod rather than by the traced process.
+var moduleEvents = []string{"module:module_load", "module:module_free"}
+
+// eventSystem returns the system of an event given as system:event.
+func eventSystem(event string) string {
+	return strings.SplitN(event, ":", 2)[0]
+}
+
+func (tc *TraceControl) filter(system string) *FileObject {
+	return tc.file(filepath.Join("events", system, "filter"))
+}
+
+func (tc *TraceControl) eventFilter(event string) *FileObject {
+	parts := strings.SplitN(event, ":", 2)
+	return tc.file(filepath.Join("events", parts[0], parts[1], "filter"))
+}
+
+func (tc *TraceControl) trigger(event string) *FileObject {
+	parts := strings.SplitN(event, ":", 2)
+	return tc.file(filepath.Join("events", parts[0], parts[1], "trigger"))
+}
+
+// restoreFilter writes a saved filter back, "none" is read from a file
+// without filter and writing 0 clears it.
+func restoreFilter(file *FileObject, filter string) error {
+	if strings.TrimSpace(filter) == "none" {
+		filter = "0"
+	}
+	return file.Replace(filter)
+}
+
+func (tc *TraceControl) file(name string) *FileObject {
+	return &FileObject{filepath.Join(tc.Root, name), nil}
+}
+
+// saveState saves the tracing configuration and the filters of the
+// event systems given and of each of their events.
+func (tc *TraceControl) saveState(systems ...string) (*traceState, error) {
+	var err error
+
+	state := &traceState{filters: make(map[string]string),
+		eventFilters: make(map[string]string)}
+	state.tracingOn, err = tc.file("tracing_on").ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	state.setEvent, err = tc.file("set_event").Read()
+	if err != nil {
+		return nil, err
+	}
+	state.setEventPid, err = tc.file("set_event_pid").Read()
+	if err != nil {
+		return nil, err
+	}
+	for _, system := range systems {
+		state.filters[system], err = tc.filter(system).Read()
+		if err != nil {
+			return nil, err
+		}
+		paths, err := filepath.Glob(filepath.Join(tc.Root, "events", system, "*", "filter"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			event := system + ":" + filepath.Base(filepath.Dir(path))
+			state.eventFilters[event], err = tc.eventFilter(event).Read()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return state, nil
+}
+
+func (tc *TraceControl) restoreState(state *traceState) error {
+	err := tc.file("tracing_on").WriteInt(0)
+	if err != nil {
+		return err
+	}
+	err = tc.file("set_event").Replace(state.setEvent)
+	if err != nil {
+		return err
+	}
+	err = tc.file("set_event_pid").Replace(state.setEventPid)
+	if err != nil {
+		return err
+	}
+	for _, event := range state.stackEvents {
+		err = tc.trigger(event).Write("!stacktrace")
+		if err != nil {
+			return err
+		}
+	}
+	// a system filter replaces the filters of all its events, so these
+	// are restored after it
+	for system, filter := range state.filters {
+		err = restoreFilter(tc.filter(system), filter)
+		if err != nil {
+			return err
+		}
+	}
+	for event, filter := range state.eventFilters {
+		err = restoreFilter(tc.eventFilter(event), filter)
+		if err != nil {
+			return err
+		}
+	}
+	return tc.file("tracing_on").WriteInt(state.tracingOn)
+}
+
+// Start clears the trace buffer, enables the given events for pid
+// and the global events for all processes, and turns tracing on. A
+// negative pid traces all processes. The pid is set as filter of the
+// event systems, so saveState must be given these systems.
+func (tc *TraceControl) Start(events []string, pid int, global []string) error {
+	err := tc.file("tracing_on").WriteInt(0)
+	if err != nil {
+		return err
+	}
+	err = tc.file("trace").Replace("")
+	if err != nil {
+		return err
+	}
+	all := append(append([]string{}, events...), global...)
+	err = tc.file("set_event").Replace(strings.Join(all, "\n") + "\n")
+	if err != nil {
+		return err
+	}
+	// set_event_pid would also filter the global events
+	err = tc.file("set_event_pid").Replace("")
+	if err != nil {
+		return err
+	}
+	filter := "0"
+	if pid >= 0 {
+		filter = fmt.Sprintf("common_pid == %d", pid)
+	}
+	for _, event := range events {
+		err = tc.filter(eventSystem(event)).Replace(filter)
+		if err != nil {
+			return err
+		}
+	}
+	return tc.file("tracing_on").WriteInt(1)
+}
+
+// StackTrace adds a stacktrace trigger to event, for pid only unless
+// pid is negative, so that each event is followed by the kernel stack
+// it was raised from. restoreState removes it.
+func (tc *TraceControl) StackTrace(state *traceState, event string, pid int) error {
+	trigger := "stacktrace"
+	if pid >= 0 {
+		trigger += fmt.Sprintf(" if common_pid == %d", pid)
+	}
+	// appended, truncating the file would remove other triggers
+	err := tc.trigger(event).Write(trigger)
+	if err != nil {
+		return err
+	}
+	state.stackEvents = append(state.stackEvents, event)
+	return nil
+}
+
+// Stop turns tracing off and copies the trace buffer to output_file.
+func (tc *TraceControl) Stop(output_file string) error {
+	err := tc.file("tracing_on").WriteInt(0)
+	if err != nil {
+		return err
+	}
+
+	trace := tc.file("trace")
+	err = trace.OpenRO()
+	if err != nil {
+		return err
+	}
+	defer trace.Close()
+
+	out, err := os.Create(output_file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, trace.File)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// StopRaw waits for stop to be requested while the per cpu binary
+// buffers are copied to dump_dir, then turns tracing off and drains
+// the buffers.
+func (tc *TraceControl) StopRaw(dump_dir string, duration time.Duration) error {
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- tracefs.DumpRaw(tc.Root, dump_dir, stop)
+	}()
+
+	waitForStop(duration)
+	err := tc.file("tracing_on").WriteInt(0)
+	close(stop)
+	if derr := <-done; derr != nil {
+		return derr
+	}
+	return err
+}
+
+// saveSymbols saves a symbol snapshot of the running kernel with the
+// module layouts seen while tracing.
+func saveSymbols(path string, layouts []*symsnap.Layout) error {
+	snap, err := symsnap.Capture()
+	if err != nil {
+		return err
+	}
+	snap.Layouts = layouts
+	return snap.Save(path)
+}
+
+func waitForStop(duration time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	if duration == 0 {
+		<-sig
+		return
+	}
+	select {
+	case <-sig:
+	case <-time.After(duration):
+	}
+}
+
+func runRecord(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	pid := fs.Int("pid", -1, "pid whose memory allocations to be tracked")
+	duration := fs.Duration("duration", 0, "stop after duration instead of waiting for Ctrl-C")
+	output := fs.String("output", "trace.txt", "file to save the trace to")
+	raw := fs.Bool("raw", false, "save the binary per cpu buffers to the output directory")
+	root := fs.String("tracefs", tracefs.DefaultRoot, "tracefs root directory")
+	modulePoll := fs.Duration("module-poll", 100*time.Millisecond,
+		"interval to check for modules loaded while tracing")
+	pageStacks := fs.Bool("page-stacks", false,
+		"trace the stack of page allocations to find their call sites")
+	fs.Parse(args)
+
+	formatsDir := *output + formatsSuffix
+	if *raw {
+		// a raw dump is a directory with the tracefs layout
+		formatsDir = *output
+	}
+
+	if *pid < 0 {
+		fs.Usage()
+		return fmt.Errorf("pid is required")
+	}
+
+	tc := &TraceControl{Root: *root}
+	state, err := tc.saveState("kmem")
+	if err != nil {
+		return err
+	}
+
+	if *pageStacks {
+		err = tc.StackTrace(state, "kmem:mm_page_alloc", *pid)
+		if err != nil {
+			tc.restoreState(state)
+			return err
+		}
+	}
+	err = tc.Start([]string{"kmem:*"}, *pid, moduleEvents)
+	if err != nil {
+		tc.restoreState(state)
+		return err
+	}
+	// keep the layout of modules reloaded while tracing
+	watcher := symsnap.Watch(*modulePoll, func() float64 {
+		return tracefs.Now(*root)
+	})
+	fmt.Printf("Tracing pid %d, press Ctrl-C to stop\n", *pid)
+	if *raw {
+		err = tc.StopRaw(*output, *duration)
+	} else {
+		waitForStop(*duration)
+		err = tc.Stop(*output)
+	}
+	if err == nil && !*raw {
+		// before tracing is restored and counts more events
+		serr := tracefs.SaveStats(*root, formatsDir)
+		if serr != nil {
+			fmt.Println("Fail to save cpu stats:", serr)
+		}
+	}
+	layouts := watcher.Stop()
+	if err == nil {
+		// while the traced modules are still loaded
+		serr := saveSymbols(symbolsPath(*output, *raw), layouts)
+		if serr != nil {
+			fmt.Println("Fail to save symbol snapshot:", serr)
+		}
+	}
+	rerr := tc.restoreState(state)
+	if err != nil {
+		return err
+	}
+	if rerr != nil {
+		return rerr
+	}
+	// keep the event formats of this kernel next to the trace so that
+	// the trace can be validated when analysed elsewhere
+	err = tracefs.SaveFormats(*root, formatsDir, "kmem", "module")
+	if err != nil {
+		fmt.Println("Fail to save event formats:", err)
+	}
+	fmt.Printf("Trace saved to %s\n", *output)
+	return nil
+}
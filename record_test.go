@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeTracefs writes a tracefs tree with plain files to dir. The
+// kmalloc event has a filter of its own, as set by the user.
+func newFakeTracefs(t *testing.T, dir string) {
+	files := map[string]string{
+		"tracing_on":                        "1\n",
+		"trace":                             "",
+		"set_event":                         "sched:sched_switch\n",
+		"set_event_pid":                     "7\n",
+		"events/kmem/filter":                "none\n",
+		"events/kmem/kmalloc/filter":        "bytes_req > 4096\n",
+		"events/kmem/kmalloc/trigger":       "",
+		"events/kmem/kfree/filter":          "none\n",
+		"events/kmem/kfree/trigger":         "",
+		"events/kmem/mm_page_alloc/filter":  "none\n",
+		"events/kmem/mm_page_alloc/trigger": "",
+		"events/module/module_load/filter":  "none\n",
+		"events/module/module_load/trigger": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFakeFile reads a file of the tree without the trailing newline
+// the kernel prints and plain files may keep after a shorter write.
+func readFakeFile(t *testing.T, dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+func TestRecordRestoresState(t *testing.T) {
+	dir := t.TempDir()
+	newFakeTracefs(t, dir)
+	tc := &TraceControl{Root: dir}
+
+	state, err := tc.saveState("kmem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tc.StackTrace(state, "kmem:mm_page_alloc", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tc.Start([]string{"kmem:*"}, 42, moduleEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"tracing_on":                        "1",
+		"set_event":                         "kmem:*\nmodule:module_load\nmodule:module_free",
+		"set_event_pid":                     "",
+		"events/kmem/filter":                "common_pid == 42",
+		"events/kmem/mm_page_alloc/trigger": "stacktrace if common_pid == 42",
+	} {
+		if got := readFakeFile(t, dir, name); got != want {
+			t.Errorf("%s while tracing is %q, want %q", name, got, want)
+		}
+	}
+
+	// the kernel applies a system filter to every event of the system
+	for _, event := range []string{"kmalloc", "kfree", "mm_page_alloc"} {
+		os.WriteFile(filepath.Join(dir, "events/kmem", event, "filter"),
+			[]byte("common_pid == 42\n"), 0644)
+	}
+	os.WriteFile(filepath.Join(dir, "trace"), []byte("kmalloc event\n"), 0644)
+	output := filepath.Join(t.TempDir(), "trace.txt")
+	err = tc.Stop(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFakeFile(t, filepath.Dir(output), "trace.txt"); got != "kmalloc event" {
+		t.Errorf("saved trace %q", got)
+	}
+	err = tc.restoreState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"tracing_on":                       "1",
+		"set_event":                        "sched:sched_switch",
+		"set_event_pid":                    "7",
+		"events/kmem/filter":               "0",
+		"events/kmem/kmalloc/filter":       "bytes_req > 4096",
+		"events/kmem/kfree/filter":         "0",
+		"events/kmem/mm_page_alloc/filter": "0",
+		// not part of the saved systems
+		"events/module/module_load/filter": "none",
+	} {
+		if got := readFakeFile(t, dir, name); got != want {
+			t.Errorf("%s after stop is %q, want %q", name, got, want)
+		}
+	}
+	// plain files keep the end of the trigger that was removed
+	trigger := readFakeFile(t, dir, "events/kmem/mm_page_alloc/trigger")
+	if !strings.HasPrefix(trigger, "!stacktrace") {
+		t.Errorf("mm_page_alloc trigger after stop is %q", trigger)
+	}
+	for _, event := range []string{"kmalloc", "kfree"} {
+		name := filepath.Join("events/kmem", event, "trigger")
+		if got := readFakeFile(t, dir, name); got != "" {
+			t.Errorf("%s after stop is %q", name, got)
+		}
+	}
+}
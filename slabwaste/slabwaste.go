@@ -0,0 +1,172 @@
+// Package slabwaste sums the bytes requested from slab allocators
+// against the bytes allocated, the difference being lost to rounding up
+// to the object size of the cache.
+package slabwaste
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Usage is the requested and allocated bytes of a call site or of a
+// kmalloc size class.
+type Usage struct {
+	Name      string
+	Count     uint64
+	Requested uint64
+	Allocated uint64
+}
+
+// Waste returns the bytes allocated but not requested.
+func (u *Usage) Waste() uint64 {
+	if u.Allocated < u.Requested {
+		return 0
+	}
+	return u.Allocated - u.Requested
+}
+
+// Percent returns the waste in percent of the allocated bytes.
+func (u *Usage) Percent() float64 {
+	if u.Allocated == 0 {
+		return 0
+	}
+	return float64(u.Waste()) * 100 / float64(u.Allocated)
+}
+
+// Report is the waste of the allocations of a trace by call site and
+// by kmalloc size class.
+type Report struct {
+	total   Usage
+	sites   map[string]*Usage
+	classes map[uint64]*Usage
+}
+
+func New() *Report {
+	return &Report{total: Usage{Name: "total"},
+		sites:   make(map[string]*Usage),
+		classes: make(map[uint64]*Usage)}
+}
+
+func add(u *Usage, requested uint64, allocated uint64) {
+	u.Count++
+	u.Requested += requested
+	u.Allocated += allocated
+}
+
+// Add adds an allocation of site. kmalloc tells whether it came from
+// the kmalloc caches, whose object size, allocated, is the size class.
+// Allocations of kernels not tracing the requested size have requested
+// 0 and are skipped.
+func (r *Report) Add(site string, kmalloc bool, requested uint64, allocated uint64) {
+	if requested == 0 {
+		return
+	}
+	add(&r.total, requested, allocated)
+
+	u := r.sites[site]
+	if u == nil {
+		u = &Usage{Name: site}
+		r.sites[site] = u
+	}
+	add(u, requested, allocated)
+
+	if !kmalloc {
+		return
+	}
+	c := r.classes[allocated]
+	if c == nil {
+		c = &Usage{Name: fmt.Sprintf("kmalloc-%d", allocated)}
+		r.classes[allocated] = c
+	}
+	add(c, requested, allocated)
+}
+
+// Group returns the report with the sites merged under the names name
+// returns for them, such as their function or module.
+func (r *Report) Group(name func(site string) string) *Report {
+	g := &Report{total: r.total, sites: make(map[string]*Usage),
+		classes: r.classes}
+	for site, u := range r.sites {
+		n := name(site)
+		m := g.sites[n]
+		if m == nil {
+			m = &Usage{Name: n}
+			g.sites[n] = m
+		}
+		m.Count += u.Count
+		m.Requested += u.Requested
+		m.Allocated += u.Allocated
+	}
+	return g
+}
+
+// Empty tells whether no allocation with a requested size was added.
+func (r *Report) Empty() bool {
+	return r.total.Count == 0
+}
+
+// Sites returns the call sites by waste, largest first.
+func (r *Report) Sites() []*Usage {
+	usages := make([]*Usage, 0, len(r.sites))
+	for _, u := range r.sites {
+		usages = append(usages, u)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Waste() != usages[j].Waste() {
+			return usages[i].Waste() > usages[j].Waste()
+		}
+		return usages[i].Name < usages[j].Name
+	})
+	return usages
+}
+
+// Classes returns the kmalloc size classes by size.
+func (r *Report) Classes() []*Usage {
+	sizes := make([]uint64, 0, len(r.classes))
+	for size := range r.classes {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	usages := make([]*Usage, 0, len(sizes))
+	for _, size := range sizes {
+		usages = append(usages, r.classes[size])
+	}
+	return usages
+}
+
+func printUsage(u *Usage) {
+	fmt.Printf("%12v %12v %12v %7.1f%% %10v  %s\n", u.Requested, u.Allocated,
+		u.Waste(), u.Percent(), u.Count, u.Name)
+}
+
+func printHeader(column string) {
+	fmt.Printf("%12s %12s %12s %8s %10s  %s\n", "requested", "allocated",
+		"waste", "waste%", "objects", column)
+}
+
+// Print prints the waste by kmalloc size class and by site, top sites
+// only when top is more than 0. column names what the sites are.
+func (r *Report) Print(column string, top int) {
+	if r.Empty() {
+		return
+	}
+	fmt.Println("Slab waste, bytes requested against bytes allocated:")
+	printHeader("")
+	printUsage(&r.total)
+	if classes := r.Classes(); len(classes) != 0 {
+		fmt.Println("by kmalloc size class:")
+		printHeader("size class")
+		for _, u := range classes {
+			printUsage(u)
+		}
+	}
+	fmt.Printf("by %s:\n", column)
+	printHeader(column)
+	for i, u := range r.Sites() {
+		if top > 0 && i >= top {
+			break
+		}
+		printUsage(u)
+	}
+}
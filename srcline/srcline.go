@@ -0,0 +1,343 @@
+// Package srcline maps code addresses of vmlinux and kernel modules to
+// source file, line and inlined function chain using DWARF debug info.
+package srcline
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Mellanox/kmtracker/modpath"
+)
+
+// DebugRoot is where distributions install separate debug files.
+var DebugRoot = "/usr/lib/debug"
+
+// Frame is one function of an inline chain and the source line it is
+// at.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s:%d", f.File, f.Line)
+}
+
+// Location is the source position of an address. Frames holds the
+// inline chain, innermost function first. The last frame is the
+// function the code was compiled into.
+type Location struct {
+	File   string
+	Line   int
+	Frames []Frame
+}
+
+// String returns file:line of the address.
+func (loc *Location) String() string {
+	return fmt.Sprintf("%s:%d", loc.File, loc.Line)
+}
+
+// Inlined returns the inline chain as "f1 (file:line) <- f2 (file:line)"
+// or an empty string when the address is not in inlined code.
+func (loc *Location) Inlined() string {
+	if len(loc.Frames) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(loc.Frames))
+	for _, f := range loc.Frames {
+		parts = append(parts, fmt.Sprintf("%s (%s)", f.Function, f))
+	}
+	return strings.Join(parts, " <- ")
+}
+
+// Table resolves addresses of one ELF file. Addresses are those of the
+// file, for a relocatable module they are offsets in its sections, so
+// an address may match code of .text and of .init.text alike.
+type Table struct {
+	file   *elf.File
+	closer io.Closer
+	data   *dwarf.Data
+	// symbol name to value in the file
+	values map[string]uint64
+
+	mu sync.Mutex
+	// compilation unit offset to its line table
+	lines map[dwarf.Offset]*dwarf.LineReader
+}
+
+// openELF opens an ELF file, compressed modules included.
+func openELF(path string) (*elf.File, io.Closer, error) {
+	r, err := modpath.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := elf.NewFile(r)
+	if err != nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, r, nil
+}
+
+// Open loads the debug info of path, or of its separate debug file
+// when path itself is stripped.
+func Open(path string) (*Table, error) {
+	f, closer, err := openELF(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Section(".debug_info") == nil {
+		debugPath := FindDebugFile(path, f)
+		closer.Close()
+		if len(debugPath) == 0 {
+			return nil, fmt.Errorf("%s: no debug info", path)
+		}
+		f, closer, err = openELF(debugPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t, err := newTable(f)
+	if err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	t.closer = closer
+	return t, nil
+}
+
+func newTable(f *elf.File) (*Table, error) {
+	data, err := f.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{file: f, data: data, values: make(map[string]uint64),
+		lines: make(map[dwarf.Offset]*dwarf.LineReader)}
+	syms, _ := f.Symbols()
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC {
+			continue
+		}
+		if _, ok := t.values[sym.Name]; !ok || elf.ST_BIND(sym.Info) == elf.STB_GLOBAL {
+			t.values[sym.Name] = sym.Value
+		}
+	}
+	return t, nil
+}
+
+func (t *Table) Close() error {
+	return t.closer.Close()
+}
+
+// buildID returns the GNU build id of f in hex.
+func buildID(f *elf.File) string {
+	section := f.Section(".note.gnu.build-id")
+	if section == nil {
+		return ""
+	}
+	note, err := section.Data()
+	if err != nil || len(note) < 16 {
+		return ""
+	}
+	// namesz, descsz, type, "GNU\0", desc
+	nameSize := f.ByteOrder.Uint32(note[0:])
+	descSize := f.ByteOrder.Uint32(note[4:])
+	start := 12 + (int(nameSize)+3)&^3
+	if start+int(descSize) > len(note) {
+		return ""
+	}
+	return hex.EncodeToString(note[start : start+int(descSize)])
+}
+
+// FindDebugFile returns the separate debug file of path, which is
+// path.debug, the same path below DebugRoot or the build id file below
+// DebugRoot/.build-id. Debug files of compressed modules are named after
+// the uncompressed .ko. f is the open file of path, it may be nil.
+func FindDebugFile(path string, f *elf.File) string {
+	abs, err := filepath.Abs(modpath.Uncompressed(path))
+	if err != nil {
+		abs = modpath.Uncompressed(path)
+	}
+	candidates := []string{abs + ".debug",
+		filepath.Join(DebugRoot, abs) + ".debug",
+		filepath.Join(DebugRoot, abs)}
+	if f != nil {
+		if id := buildID(f); len(id) > 2 {
+			candidates = append(candidates,
+				filepath.Join(DebugRoot, ".build-id", id[:2], id[2:]+".debug"))
+		}
+	}
+	for _, candidate := range candidates {
+		if candidate == abs {
+			continue
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// LookupSymbol returns the location of offset bytes into the function
+// name. It avoids translating run time addresses, which differ from the
+// file ones with KASLR and for modules.
+func (t *Table) LookupSymbol(name string, offset uint64) (*Location, error) {
+	value, ok := t.values[name]
+	if !ok {
+		return nil, fmt.Errorf("symbol %s not found", name)
+	}
+	return t.lookup(value+offset, name)
+}
+
+func (t *Table) lineReader(cu *dwarf.Entry) (*dwarf.LineReader, error) {
+	lr, ok := t.lines[cu.Offset]
+	if ok {
+		return lr, nil
+	}
+	lr, err := t.data.LineReader(cu)
+	if err != nil {
+		return nil, err
+	}
+	if lr == nil {
+		return nil, fmt.Errorf("no line table")
+	}
+	t.lines[cu.Offset] = lr
+	return lr, nil
+}
+
+// Lookup returns the location of the file address pc.
+func (t *Table) Lookup(pc uint64) (*Location, error) {
+	return t.lookup(pc, "")
+}
+
+// lookup resolves pc, function names the function containing it when
+// known, which tells apart functions of different sections of a
+// module at the same offset.
+func (t *Table) lookup(pc uint64, function string) (*Location, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := t.data.Reader()
+	cu, err := r.SeekPC(pc)
+	if err != nil {
+		return nil, err
+	}
+	lr, err := t.lineReader(cu)
+	if err != nil {
+		return nil, err
+	}
+	var line dwarf.LineEntry
+	err = lr.SeekPC(pc, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	compDir, _ := cu.Val(dwarf.AttrCompDir).(string)
+	loc := &Location{File: relPath(compDir, line.File.Name), Line: line.Line}
+
+	chain := t.scopes(r, pc, function)
+	files := lr.Files()
+	file, lineNo := loc.File, loc.Line
+	for i := len(chain) - 1; i >= 0; i-- {
+		e := chain[i]
+		loc.Frames = append(loc.Frames, Frame{Function: t.name(e),
+			File: file, Line: lineNo})
+		// the caller is at the call site of the inlined function
+		idx, _ := e.Val(dwarf.AttrCallFile).(int64)
+		call, _ := e.Val(dwarf.AttrCallLine).(int64)
+		if idx > 0 && int(idx) < len(files) && files[idx] != nil {
+			file = relPath(compDir, files[idx].Name)
+		}
+		lineNo = int(call)
+	}
+	return loc, nil
+}
+
+func relPath(compDir string, name string) string {
+	if len(compDir) != 0 && strings.HasPrefix(name, compDir+"/") {
+		return name[len(compDir)+1:]
+	}
+	return name
+}
+
+func contains(ranges [][2]uint64, pc uint64) bool {
+	for _, r := range ranges {
+		if pc >= r[0] && pc < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// scopes returns the subprogram containing pc followed by the inlined
+// subroutines containing it, outermost first. r is positioned at the
+// children of the compilation unit. Other subprograms than function
+// are skipped unless it is empty.
+func (t *Table) scopes(r *dwarf.Reader, pc uint64, function string) []*dwarf.Entry {
+	var chain []*dwarf.Entry
+
+	depth := 0
+	for {
+		e, err := r.Next()
+		if err != nil || e == nil {
+			break
+		}
+		if e.Tag == 0 {
+			depth--
+			if depth < 0 || (len(chain) != 0 && depth == 0) {
+				break
+			}
+			continue
+		}
+		switch e.Tag {
+		case dwarf.TagSubprogram, dwarf.TagInlinedSubroutine, dwarf.TagLexDwarfBlock:
+			ranges, _ := t.data.Ranges(e)
+			in := contains(ranges, pc)
+			if in && depth == 0 && len(function) != 0 && t.name(e) != function {
+				in = false
+			}
+			if in {
+				if e.Tag != dwarf.TagLexDwarfBlock {
+					chain = append(chain, e)
+				}
+				if e.Children {
+					depth++
+				}
+				continue
+			}
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+	}
+	return chain
+}
+
+// name returns the function name of a subprogram or inlined
+// subroutine, following its abstract origin or specification.
+func (t *Table) name(e *dwarf.Entry) string {
+	for i := 0; i < 4 && e != nil; i++ {
+		if name, ok := e.Val(dwarf.AttrName).(string); ok {
+			return name
+		}
+		off, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			off, ok = e.Val(dwarf.AttrSpecification).(dwarf.Offset)
+		}
+		if !ok {
+			break
+		}
+		r := t.data.Reader()
+		r.Seek(off)
+		e, _ = r.Next()
+	}
+	return "?"
+}
@@ -2,8 +2,18 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/Mellanox/kmtracker/elfsym"
+	"github.com/Mellanox/kmtracker/modpath"
+	"github.com/Mellanox/kmtracker/srcline"
+	"github.com/Mellanox/kmtracker/symindex"
+	"github.com/Mellanox/kmtracker/symsnap"
+	"github.com/Mellanox/kmtracker/tracefs"
 )
 
 type Symbol struct {
@@ -11,6 +21,8 @@ type Symbol struct {
 	Module       string
 	StartAddress uint64 // updated from /proc/kallsyms
 	EndAddress   uint64 // updated from <module>.ko
+	// EndAddress derived from the address of the next symbol
+	Estimated bool
 }
 
 type ModuleSymbols struct {
@@ -21,6 +33,86 @@ type ModuleSymbols struct {
 
 type KernelSymbols struct {
 	ModulesSymbols map[string]*ModuleSymbols
+	// address ranges of all symbols with a known length
+	index *symindex.Index
+
+	// module name to its vmlinux or .ko file
+	files map[string]string
+	// debug info of the files, nil when there is none
+	tables    map[string]*srcline.Table
+	locations map[locationKey]*srcline.Location
+	// kernel state the symbols were read from, nil for the running
+	// kernel
+	snapshot *symsnap.Snapshot
+	// module name to .ko file
+	modules *modpath.Resolver
+	// loads of the modules reloaded while tracing, nil when none
+	timeline *ModuleTimeline
+}
+
+// locationKey is a code address as symbol and offset, which stays the
+// same across loads of a module.
+type locationKey struct {
+	module string
+	name   string
+	offset uint64
+}
+
+// BuildIndex indexes the symbols by address, it is done once all
+// symbol lengths are known.
+func (symbols *KernelSymbols) BuildIndex() {
+	var ranges []symindex.Range
+
+	for _, modSymbols := range symbols.ModulesSymbols {
+		for _, sym := range modSymbols.Symbols {
+			if sym.EndAddress == 0 {
+				continue
+			}
+			ranges = append(ranges, symindex.Range{Start: sym.StartAddress,
+				End: sym.EndAddress, Name: sym.Name, Module: sym.Module,
+				Estimated: sym.Estimated})
+		}
+	}
+	symbols.index = symindex.New(ranges)
+}
+
+func (symbols *KernelSymbols) debugTable(module string) *srcline.Table {
+	table, ok := symbols.tables[module]
+	if ok {
+		return table
+	}
+	if path := symbols.files[module]; len(path) != 0 {
+		var err error
+		table, err = srcline.Open(path)
+		if err != nil {
+			fmt.Println("No source lines for", module+":", err)
+			table = nil
+		}
+	}
+	symbols.tables[module] = table
+	return table
+}
+
+// SourceLocation returns the source line and inline chain of addr in
+// sym from the debug info of vmlinux or of the module holding it, nil
+// when not available.
+func (symbols *KernelSymbols) SourceLocation(addr uint64, sym *symindex.Range) *srcline.Location {
+	key := locationKey{module: sym.Module, name: sym.Name, offset: addr - sym.Start}
+	if loc, ok := symbols.locations[key]; ok {
+		return loc
+	}
+	var loc *srcline.Location
+	if table := symbols.debugTable(sym.Module); table != nil {
+		// call sites are return addresses, the call is the
+		// instruction before
+		offset := key.offset
+		if offset > 0 {
+			offset--
+		}
+		loc, _ = table.LookupSymbol(sym.Name, offset)
+	}
+	symbols.locations[key] = loc
+	return loc
 }
 
 // build module list from the kallsyms
@@ -41,9 +133,6 @@ func BuildModulesList(kallsyms_map *map[string]*Symbol) map[string]int {
 
 func BuildKallsymsMap() (*KernelSymbols, error) {
 
-	var module_symbols, kernel_symbols int
-	var modSymbols *ModuleSymbols
-
 	file := FileObject{"/proc/kallsyms", nil}
 	//file := FileObject{ "1.txt", nil }
 
@@ -52,10 +141,33 @@ func BuildKallsymsMap() (*KernelSymbols, error) {
 		fmt.Println("Fail to read file")
 		return nil, err
 	}
+	return ParseKallsyms(data)
+}
+
+// ParseKallsyms builds the symbol map from /proc/kallsyms content,
+// which can also come from a trace.dat file.
+func ParseKallsyms(data string) (*KernelSymbols, error) {
+	symbols, module_symbols, kernel_symbols := parseKallsyms(data)
+
+	fmt.Println("\tTotal module symbols = ", module_symbols)
+	fmt.Println("\tTotal kernel symbols = ", kernel_symbols)
+	return symbols, nil
+}
+
+// parseKallsyms returns the symbol map of kallsyms content and the
+// count of module and kernel symbols.
+func parseKallsyms(data string) (*KernelSymbols, int, int) {
+
+	var module_symbols, kernel_symbols int
+	var modSymbols *ModuleSymbols
+
 	array := strings.Split(data, "\n")
 
 	symbols := new(KernelSymbols)
 	symbols.ModulesSymbols = make(map[string]*ModuleSymbols)
+	symbols.files = make(map[string]string)
+	symbols.tables = make(map[string]*srcline.Table)
+	symbols.locations = make(map[locationKey]*srcline.Location)
 
 	for _, line := range array {
 
@@ -100,80 +212,138 @@ func BuildKallsymsMap() (*KernelSymbols, error) {
 		//address->symbol map
 		modSymbols.Symbols[string(words[0])] = symbol
 	}
+	return symbols, module_symbols, kernel_symbols
+}
 
-	fmt.Println("\tTotal module symbols = ", module_symbols)
-	fmt.Println("\tTotal kernel symbols = ", kernel_symbols)
-	return symbols, nil
+// moduleResolver finds the .ko files of modules, in the directories
+// given by the user first and then in /lib/modules of the kernel
+// release.
+func moduleResolver(release string, module_dirs []string) *modpath.Resolver {
+	if len(release) == 0 {
+		release = modpath.Release()
+	}
+	resolver := modpath.New()
+	for _, dir := range append(module_dirs, modpath.Dir(release)) {
+		err := resolver.Add(dir)
+		if err != nil {
+			fmt.Println("Fail to read modules:", err)
+		}
+	}
+	fmt.Printf("\tTotal module files = %d\n", resolver.Len())
+	return resolver
 }
 
-func GetModuleKoFileName(module_name string) (string, error) {
+// GetModuleSymbols returns the .symtab entries of a vmlinux or .ko
+// file.
+func GetModuleSymbols(module_file string) ([]elfsym.Symbol, error) {
 
-	cmdString := "modinfo " + module_name
+	file, err := modpath.Open(module_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	output := execShellCmdOutput(cmdString)
-	if len(output) == 0 {
-		return "", fmt.Errorf("Module not found")
+	symbols, err := elfsym.ReadSymbols(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", module_file, err)
 	}
-	lines := strings.Split(output, "\n")
-	line0 := strings.Trim(lines[0], "filename:")
-	line0 = strings.TrimLeft(line0, " ")
-	return string(line0), nil
+	return symbols, nil
 }
 
 // GetModuleSymbolsLen
 // Returns map: key(text symbol name) -> value (length of the symbol)
+// read from the .symtab of a vmlinux or .ko file.
 func GetModuleSymbolsLen(module_file string) (map[string]uint64, error) {
 
-	//fmt.Println(module_file)
+	symbols, err := GetModuleSymbols(module_file)
+	if err != nil {
+		return make(map[string]uint64), err
+	}
+	return elfsym.Sizes(symbols), nil
+}
 
-	objdumpSymbols := make(map[string]uint64)
-	cmdString := "objdump -t " + module_file
+// moduleSections returns the load address of the sections of a module,
+// from the snapshot or from /sys/module of the running kernel.
+func (symbols *KernelSymbols) moduleSections(module string) map[string]uint64 {
+	if symbols.snapshot != nil {
+		if m := symbols.snapshot.Modules[module]; m != nil {
+			return m.Sections
+		}
+		return nil
+	}
+	sections, err := symsnap.ReadSections(module)
+	if err != nil {
+		return nil
+	}
+	return sections
+}
 
-	output := execShellCmdOutput(cmdString)
-	if len(output) == 0 {
-		return objdumpSymbols, fmt.Errorf("Module objdump error")
+// relocate_module_symbols sets the end of the kallsyms symbols of a
+// module from its .ko symbols relocated to their load address. Symbols
+// missing in kallsyms, such as the ones of .init.text freed once the
+// module is initialised, are added. It returns the count of updated and
+// added symbols.
+func relocate_module_symbols(modSymbols *ModuleSymbols, module string,
+	relocated []elfsym.Symbol) (int, int) {
+	var update_cnt, add_cnt int
+
+	byAddress := make(map[uint64]*Symbol)
+	for _, ksym := range modSymbols.Symbols {
+		byAddress[ksym.StartAddress] = ksym
+	}
+	for _, rsym := range relocated {
+		ksym := byAddress[rsym.Value]
+		if ksym != nil {
+			if ksym.EndAddress == 0 {
+				ksym.EndAddress = ksym.StartAddress + rsym.Size - 1
+				update_cnt++
+			}
+			continue
+		}
+		ksym = &Symbol{Name: rsym.Name, Module: module,
+			StartAddress: rsym.Value,
+			EndAddress:   rsym.Value + rsym.Size - 1}
+		modSymbols.Symbols[fmt.Sprintf("%016x", rsym.Value)] = ksym
+		byAddress[rsym.Value] = ksym
+		add_cnt++
 	}
-	lines := strings.Split(output, "\n")
-	//skip 4 lines
-	lines = lines[4:]
+	return update_cnt, add_cnt
+}
 
-	for _, line := range lines {
+// update_module_symbols_len sets the end of the symbols of module
+// from its .ko file. sections are the load addresses of its sections,
+// nil when not known. It returns the count of updated and added
+// symbols.
+func update_module_symbols_len(modSymbols *ModuleSymbols, module string,
+	file string, sections map[string]uint64) (int, int, error) {
 
-		line = strings.Replace(line, "\t", " ", -1)
-		if strings.Contains(line, ".text..refcount") {
+	moduleSymbols, err := GetModuleSymbols(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	// exact addresses when the section addresses are known, the
+	// sizes by name are a fallback for the remaining symbols
+	relocated := elfsym.Relocate(moduleSymbols, sections)
+	update_cnt, add_cnt := relocate_module_symbols(modSymbols, module, relocated)
+
+	elfSymbols := elfsym.Sizes(moduleSymbols)
+	for _, ksym := range modSymbols.Symbols {
+		if ksym.EndAddress != 0 {
 			continue
 		}
-
-		if strings.Contains(line, ".init.text") ||
-			strings.Contains(line, ".exit.text") ||
-			strings.Contains(line, ".text") {
-			words := strings.Split(line, " ")
-
-			filtered_entry := make([]string, 6)
-			cnt := 0
-			for _, word := range words {
-				if len(word) == 0 || word == " " {
-					continue
-				}
-				filtered_entry[cnt] = word
-				cnt++
-			}
-			symLen, err := strconv.ParseUint(filtered_entry[4], 16, 64)
-			if err != nil {
-				continue
-			}
-			objdumpSymbols[filtered_entry[5]] = symLen
+		lensym := elfSymbols[ksym.Name]
+		if lensym == 0 || module != ksym.Module {
+			continue
 		}
+		ksym.EndAddress = ksym.StartAddress + lensym - 1
+		update_cnt++
 	}
-
-	return objdumpSymbols, nil
+	return update_cnt, add_cnt, nil
 }
 
 func update_modules_symbols_len(symbols *KernelSymbols) error {
-	var objdumpSymbols map[string]uint64
-	var err2 error
 	var total_update_cnt int
-	var update_cnt int
+	var total_add_cnt int
 
 	fmt.Println("Updating modules symbols length")
 
@@ -181,39 +351,35 @@ func update_modules_symbols_len(symbols *KernelSymbols) error {
 		if k == "linux_kernel" {
 			continue
 		}
-		file, err := GetModuleKoFileName(k)
-		if err != nil {
+		file, ok := symbols.modules.Find(k)
+		if !ok {
 			continue
 		}
-		objdumpSymbols, err2 = GetModuleSymbolsLen(file)
-		if err2 != nil {
-			return err2
+		update_cnt, add_cnt, err := update_module_symbols_len(
+			symbols.ModulesSymbols[k], k, file, symbols.moduleSections(k))
+		if _, ok := err.(*modpath.MissingToolError); ok {
+			fmt.Printf("Warning: %v, symbols of %s are taken from kallsyms\n", err, k)
+			continue
 		}
-		update_cnt = 0
-		for _, ksym := range symbols.ModulesSymbols[k].Symbols {
-			if ksym.EndAddress != 0 {
-				continue
-			}
-			for name, lensym := range objdumpSymbols {
-				if ksym.Name == name && k == ksym.Module {
-					ksym.EndAddress = ksym.StartAddress + lensym - 1
-					//fmt.Println("name = ", ksym.Name)
-					update_cnt++
-					total_update_cnt++
-				}
-			}
+		if err != nil {
+			fmt.Println("Fail to read module symbols:", err)
+			continue
 		}
+		symbols.files[k] = file
+		total_update_cnt += update_cnt
+		total_add_cnt += add_cnt
 		//fmt.Printf("module %v = symbols resolved = %d\n",
 		//		k, update_cnt)
 	}
 	fmt.Printf("\tTotal update cnt for modules = %d\n", total_update_cnt)
+	fmt.Printf("\tTotal relocated symbols added for modules = %d\n", total_add_cnt)
 	fmt.Println("Updating modules symbols length done")
 	return nil
 }
 
 func update_kernel_symbols_len(kernel_file string,
 	kallsyms_map *ModuleSymbols) error {
-	var objdumpSymbols map[string]uint64
+	var elfSymbols map[string]uint64
 	var total_kernel_update_cnt int
 	var err3 error
 
@@ -223,7 +389,7 @@ func update_kernel_symbols_len(kernel_file string,
 	}
 
 	fmt.Println("Updating kernel symbols length")
-	objdumpSymbols, err3 = GetModuleSymbolsLen(kernel_file)
+	elfSymbols, err3 = GetModuleSymbolsLen(kernel_file)
 	if err3 != nil {
 		return err3
 	}
@@ -231,8 +397,8 @@ func update_kernel_symbols_len(kernel_file string,
 		if ksym.EndAddress != 0 {
 			continue
 		}
-		if objdumpSymbols[ksym.Name] != 0 {
-			ksym.EndAddress = ksym.StartAddress + objdumpSymbols[ksym.Name] - 1
+		if elfSymbols[ksym.Name] != 0 {
+			ksym.EndAddress = ksym.StartAddress + elfSymbols[ksym.Name] - 1
 			total_kernel_update_cnt++
 		}
 	}
@@ -241,24 +407,138 @@ func update_kernel_symbols_len(kernel_file string,
 	return nil
 }
 
-func GetLiveKernelSymbolMap(kernel_file string) (*KernelSymbols, error) {
+// estimate_symbols_len sets the end of the symbols whose length is
+// still unknown to the address before the next symbol of the same
+// module, so that call sites resolve with only /proc/kallsyms.
+func estimate_symbols_len(symbols *KernelSymbols) {
+	var total_estimate_cnt int
+
+	fmt.Println("Estimating symbols length from kallsyms")
+	for _, modSymbols := range symbols.ModulesSymbols {
+		total_estimate_cnt += estimate_module_symbols_len(modSymbols)
+	}
+	fmt.Printf("\tTotal estimated symbols = %d\n", total_estimate_cnt)
+	fmt.Println("Estimating symbols length done")
+}
+
+// estimate_module_symbols_len estimates the symbols of one module and
+// returns their count.
+func estimate_module_symbols_len(modSymbols *ModuleSymbols) int {
+	var estimate_cnt int
+
+	sorted := make([]*Symbol, 0, len(modSymbols.Symbols))
+	for _, sym := range modSymbols.Symbols {
+		sorted = append(sorted, sym)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StartAddress < sorted[j].StartAddress
+	})
+
+	for i, sym := range sorted {
+		if sym.EndAddress != 0 {
+			continue
+		}
+		// aliases share the address, the next one is further
+		next := i + 1
+		for next < len(sorted) &&
+			sorted[next].StartAddress == sym.StartAddress {
+			next++
+		}
+		if next == len(sorted) {
+			// last symbol of the module, its end is unknown
+			continue
+		}
+		sym.EndAddress = sorted[next].StartAddress - 1
+		sym.Estimated = true
+		estimate_cnt++
+	}
+	return estimate_cnt
+}
+
+// Symbol snapshot saved by record next to a text trace, or inside a raw
+// dump directory.
+const (
+	symbolsSuffix  = ".symbols.tar"
+	rawSymbolsFile = "symbols.tar"
+)
+
+func symbolsPath(trace_file string, raw bool) string {
+	if raw {
+		return filepath.Join(trace_file, rawSymbolsFile)
+	}
+	return trace_file + symbolsSuffix
+}
+
+// LoadSymbolSnapshot returns the kernel state to symbolise a trace with.
+// The snapshot given by the user is used first, then kallsyms embedded
+// in the trace and the snapshot saved by record next to the trace. nil
+// means the running kernel.
+func LoadSymbolSnapshot(trace_file string, symbols string, kallsyms string) (*symsnap.Snapshot, error) {
+	if len(symbols) == 0 && len(kallsyms) != 0 {
+		fmt.Println("Using kallsyms saved in the trace")
+		return symsnap.FromKallsyms(kallsyms), nil
+	}
+	if len(symbols) == 0 && len(trace_file) != 0 && trace_file != "-" {
+		path := symbolsPath(trace_file, tracefs.IsRawDump(trace_file))
+		if _, err := os.Stat(path); err == nil {
+			symbols = path
+		}
+	}
+	if len(symbols) == 0 {
+		fmt.Println("Using symbols of the running kernel")
+		return nil, nil
+	}
+	snapshot, err := symsnap.Load(symbols)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Using symbols from %s %s\n", symbols, snapshot)
+	return snapshot, nil
+}
+
+func GetLiveKernelSymbolMap(kernel_file string, module_dirs []string) (*KernelSymbols, error) {
+	return GetKernelSymbolMap(nil, kernel_file, module_dirs)
+}
+
+// GetKernelSymbolMap builds the symbol map from a saved snapshot of the
+// kernel, or from /proc/kallsyms when snapshot is nil. Module files are
+// searched in module_dirs before /lib/modules.
+func GetKernelSymbolMap(snapshot *symsnap.Snapshot, kernel_file string,
+	module_dirs []string) (*KernelSymbols, error) {
+	var symbols *KernelSymbols
+	var err error
 
 	fmt.Println("Building kallsyms map")
-	symbols, err := BuildKallsymsMap()
+	if snapshot != nil {
+		symbols, err = ParseKallsyms(snapshot.Kallsyms)
+	} else {
+		symbols, err = BuildKallsymsMap()
+	}
 	if err != nil {
 		return nil, err
 	}
+	symbols.snapshot = snapshot
 	fmt.Println("Building kallsyms map done")
 
 	fmt.Println("Building modules list")
 	// map: key->value,
 	//      key: kernel module(driver) name
 	//      value: is count of symbols that belong to that object.
+	var release string
+	if snapshot != nil {
+		release = snapshot.Release
+	}
+	symbols.modules = moduleResolver(release, module_dirs)
 	fmt.Println("Building modules list done")
 
 	update_modules_symbols_len(symbols)
+	if len(kernel_file) != 0 {
+		symbols.files["linux_kernel"] = kernel_file
+	}
 	update_kernel_symbols_len(kernel_file,
 		symbols.ModulesSymbols["linux_kernel"])
+	estimate_symbols_len(symbols)
+	symbols.BuildIndex()
 
 	return symbols, nil
 }
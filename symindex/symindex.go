@@ -0,0 +1,113 @@
+// Package symindex maps kernel addresses to the symbols containing them
+// using a sorted array of address ranges.
+package symindex
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Range is the address range of one symbol, End is inclusive.
+type Range struct {
+	Start  uint64
+	End    uint64
+	Name   string
+	Module string
+	// End is a guess, such as the start of the next symbol
+	Estimated bool
+}
+
+func (r *Range) Len() uint64 {
+	return r.End - r.Start + 1
+}
+
+// Index is a sorted, read only set of ranges. Lookups can be done from
+// several goroutines at once.
+type Index struct {
+	ranges []Range
+}
+
+// New returns an index of ranges. Ranges starting at the same address,
+// such as aliases, are merged into the longest one. Other overlaps are
+// not expected in kernel symbol tables, an address in the overlap of
+// two ranges resolves to the one starting last.
+func New(ranges []Range) *Index {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].End > sorted[j].End
+	})
+
+	idx := &Index{ranges: make([]Range, 0, len(sorted))}
+	for _, r := range sorted {
+		if r.End < r.Start {
+			continue
+		}
+		n := len(idx.ranges)
+		if n != 0 && idx.ranges[n-1].Start == r.Start {
+			continue
+		}
+		idx.ranges = append(idx.ranges, r)
+	}
+	return idx
+}
+
+func (idx *Index) Len() int {
+	return len(idx.ranges)
+}
+
+// Ranges returns the ranges ordered by start address.
+func (idx *Index) Ranges() []Range {
+	return idx.ranges
+}
+
+// Lookup returns the range containing addr, nil when there is none.
+func (idx *Index) Lookup(addr uint64) *Range {
+	// first range starting after addr
+	i := sort.Search(len(idx.ranges), func(i int) bool {
+		return idx.ranges[i].Start > addr
+	})
+	if i == 0 {
+		return nil
+	}
+	r := &idx.ranges[i-1]
+	if addr > r.End {
+		return nil
+	}
+	return r
+}
+
+// minChunk is the smallest number of addresses worth a goroutine.
+const minChunk = 4096
+
+// LookupAll resolves addrs in parallel, the result has the range of
+// addrs[i], or nil, at index i.
+func (idx *Index) LookupAll(addrs []uint64) []*Range {
+	var wg sync.WaitGroup
+
+	result := make([]*Range, len(addrs))
+	workers := runtime.NumCPU()
+	chunk := (len(addrs) + workers - 1) / workers
+	if chunk < minChunk {
+		chunk = minChunk
+	}
+	for start := 0; start < len(addrs); start += chunk {
+		end := start + chunk
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		wg.Add(1)
+		go func(start int, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				result[i] = idx.Lookup(addrs[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return result
+}
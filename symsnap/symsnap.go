@@ -0,0 +1,338 @@
+// Package symsnap saves and loads the symbol state of a running kernel,
+// so that a trace can be symbolised on another machine or after a
+// reboot. A snapshot is a tar file with the /proc and /sys files it was
+// taken from at their usual paths.
+package symsnap
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Root is the directory the kernel files are read from.
+var Root = "/"
+
+// Files read from the running kernel, relative to Root.
+const (
+	kallsymsFile = "proc/kallsyms"
+	modulesFile  = "proc/modules"
+	versionFile  = "proc/version"
+	releaseFile  = "proc/sys/kernel/osrelease"
+	sysModuleDir = "sys/module"
+	// layouts of modules seen while tracing are below this directory of
+	// the snapshot, one numbered directory per layout
+	layoutsDir = "layouts"
+	// time a layout was seen, in the layout directory
+	seenFile = "seen"
+)
+
+// Module is a loaded module as listed by /proc/modules.
+type Module struct {
+	Name    string
+	Size    uint64
+	Address uint64
+	// section name to load address, from /sys/module/<name>/sections
+	Sections map[string]uint64
+}
+
+// Snapshot is the symbol state of a kernel.
+type Snapshot struct {
+	// kernel release, uname -r
+	Release string
+	// content of /proc/version
+	Version  string
+	Kallsyms string
+	Modules  map[string]*Module
+	// layouts of the modules loaded while tracing, in the order they
+	// were seen
+	Layouts []*Layout
+
+	// content by path relative to Root
+	files map[string][]byte
+}
+
+// Layout is the symbol layout of one load of a module.
+type Layout struct {
+	Module *Module
+	// kallsyms lines of the module
+	Kallsyms string
+	// trace clock time in seconds the layout was seen at, 0 when not
+	// known. The load it belongs to started before and ended after it.
+	Seen float64
+
+	files map[string][]byte
+}
+
+// ParseModules parses the content of /proc/modules, lines such as
+// "mlx5_core 1236992 1 mlx5_ib, Live 0xffffffffc0a00000 (OE)".
+func ParseModules(text string) map[string]*Module {
+	modules := make(map[string]*Module)
+	for _, line := range strings.Split(text, "\n") {
+		words := strings.Fields(line)
+		if len(words) < 6 {
+			continue
+		}
+		module := &Module{Name: words[0], Sections: make(map[string]uint64)}
+		module.Size, _ = strconv.ParseUint(words[1], 10, 64)
+		module.Address, _ = strconv.ParseUint(strings.TrimPrefix(words[5], "0x"), 16, 64)
+		modules[module.Name] = module
+	}
+	return modules
+}
+
+func parseAddress(text string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(text), "0x"), 16, 64)
+}
+
+// read returns the snapshot content by path relative to root.
+func read(root string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, name := range []string{kallsymsFile, modulesFile, versionFile, releaseFile} {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			if name == kallsymsFile {
+				return nil, err
+			}
+			// no /proc/modules without CONFIG_MODULES
+			continue
+		}
+		files[name] = data
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(root, sysModuleDir, "*", "sections", "*"))
+	hidden, _ := filepath.Glob(filepath.Join(root, sysModuleDir, "*", "sections", ".*"))
+	for _, p := range append(paths, hidden...) {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			// not readable without root
+			continue
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			continue
+		}
+		files[filepath.ToSlash(rel)] = data
+	}
+	return files, nil
+}
+
+// ReadSections returns the load address of the sections of a module of
+// the running kernel, from /sys/module/<name>/sections. Addresses are
+// only readable by root.
+func ReadSections(name string) (map[string]uint64, error) {
+	dir := filepath.Join(Root, sysModuleDir, name, "sections")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]uint64)
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		addr, err := parseAddress(string(data))
+		if err != nil {
+			continue
+		}
+		sections[entry.Name()] = addr
+	}
+	return sections, nil
+}
+
+// parse builds a snapshot from its files.
+func parse(files map[string][]byte) (*Snapshot, error) {
+	kallsyms, ok := files[kallsymsFile]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", kallsymsFile)
+	}
+	snap := &Snapshot{Kallsyms: string(kallsyms), files: files}
+	snap.Release = strings.TrimSpace(string(files[releaseFile]))
+	snap.Version = strings.TrimSpace(string(files[versionFile]))
+	snap.Modules = ParseModules(string(files[modulesFile]))
+
+	for name, data := range files {
+		// sys/module/<module>/sections/<section>
+		parts := strings.Split(name, "/")
+		if len(parts) != 5 || parts[0] != "sys" || parts[3] != "sections" {
+			continue
+		}
+		module := snap.Modules[parts[2]]
+		if module == nil {
+			continue
+		}
+		addr, err := parseAddress(string(data))
+		if err != nil {
+			continue
+		}
+		module.Sections[parts[4]] = addr
+	}
+
+	layouts := make(map[string]map[string][]byte)
+	for name, data := range files {
+		// layouts/<n>/<file>
+		parts := strings.SplitN(name, "/", 3)
+		if len(parts) != 3 || parts[0] != layoutsDir {
+			continue
+		}
+		if layouts[parts[1]] == nil {
+			layouts[parts[1]] = make(map[string][]byte)
+		}
+		layouts[parts[1]][parts[2]] = data
+	}
+	for _, n := range sortedKeys(layouts) {
+		layout, err := parse(layouts[n])
+		if err != nil || len(layout.Modules) != 1 {
+			return nil, fmt.Errorf("bad module layout %s", n)
+		}
+		seen, _ := strconv.ParseFloat(strings.TrimSpace(string(layouts[n][seenFile])), 64)
+		for _, module := range layout.Modules {
+			snap.Layouts = append(snap.Layouts, &Layout{Module: module,
+				Kallsyms: layout.Kallsyms, Seen: seen, files: layout.files})
+		}
+	}
+	return snap, nil
+}
+
+func sortedKeys(m map[string]map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Capture takes a snapshot of the running kernel. Reading the real
+// addresses of kallsyms and module sections needs root.
+func Capture() (*Snapshot, error) {
+	files, err := read(Root)
+	if err != nil {
+		return nil, err
+	}
+	return parse(files)
+}
+
+// Save writes the snapshot to a tar file at path.
+func (snap *Snapshot) Save(path string) error {
+	files := make(map[string][]byte)
+	for name, data := range snap.files {
+		files[name] = data
+	}
+	for i, layout := range snap.Layouts {
+		for name, data := range layout.files {
+			files[fmt.Sprintf("%s/%04d/%s", layoutsDir, i, name)] = data
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(out)
+	now := time.Now()
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, ModTime: now,
+			Size: int64(len(files[name]))}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(files[name]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Load reads a snapshot written by Save.
+func Load(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		files[strings.TrimPrefix(hdr.Name, "./")] = buf.Bytes()
+	}
+	snap, err := parse(files)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return snap, nil
+}
+
+// FromKallsyms returns a snapshot holding only kallsyms, such as the
+// one embedded in a trace.dat file.
+func FromKallsyms(kallsyms string) *Snapshot {
+	return &Snapshot{Kallsyms: kallsyms, Modules: make(map[string]*Module),
+		files: map[string][]byte{kallsymsFile: []byte(kallsyms)}}
+}
+
+// ModuleNames returns the names of the modules sorted.
+func (snap *Snapshot) ModuleNames() []string {
+	names := make([]string, 0, len(snap.Modules))
+	for name := range snap.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (snap *Snapshot) String() string {
+	release := snap.Release
+	if len(release) == 0 {
+		release = "unknown"
+	}
+	return fmt.Sprintf("release=%s modules=%d layouts=%d", release,
+		len(snap.Modules), len(snap.Layouts))
+}
+
+// LayoutsOf returns the layouts of module name in the order they were
+// seen.
+func (snap *Snapshot) LayoutsOf(name string) []*Layout {
+	var layouts []*Layout
+	for _, layout := range snap.Layouts {
+		if layout.Module.Name == name {
+			layouts = append(layouts, layout)
+		}
+	}
+	return layouts
+}
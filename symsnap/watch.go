@@ -0,0 +1,141 @@
+package symsnap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watcher polls /proc/modules and keeps the layout of every module
+// load it sees, so that a module unloaded or reloaded while tracing can
+// still be symbolised. A reload at the same address goes unnoticed, the
+// layout is then the same anyway.
+type Watcher struct {
+	layouts []*Layout
+	// module name to load address of the modules loaded
+	addresses map[string]uint64
+	// returns the trace clock time, 0 when not known
+	clock func() float64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Watch takes the layouts of the modules loaded and polls for new ones
+// every interval until Stop. Each layout is stamped with the time of
+// clock, so that it can be matched with the module loads of the trace.
+func Watch(interval time.Duration, clock func() float64) *Watcher {
+	w := &Watcher{addresses: make(map[string]uint64), clock: clock,
+		stop: make(chan struct{}), done: make(chan struct{})}
+	w.poll()
+	go w.run(interval)
+	return w
+}
+
+func (w *Watcher) run(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// Stop ends polling and returns the layouts seen.
+func (w *Watcher) Stop() []*Layout {
+	close(w.stop)
+	<-w.done
+	w.poll()
+	return w.layouts
+}
+
+func (w *Watcher) poll() {
+	data, err := ioutil.ReadFile(filepath.Join(Root, modulesFile))
+	if err != nil {
+		return
+	}
+	// the modules read were loaded before and are unloaded after now
+	var seen float64
+	if w.clock != nil {
+		seen = w.clock()
+	}
+	lines := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if words := strings.Fields(line); len(words) != 0 {
+			lines[words[0]] = line + "\n"
+		}
+	}
+	modules := ParseModules(string(data))
+
+	var changed []string
+	for name, module := range modules {
+		addr, ok := w.addresses[name]
+		if !ok || addr != module.Address {
+			changed = append(changed, name)
+			w.addresses[name] = module.Address
+		}
+	}
+	for name := range w.addresses {
+		if modules[name] == nil {
+			delete(w.addresses, name)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+
+	kallsyms, err := ioutil.ReadFile(filepath.Join(Root, kallsymsFile))
+	if err != nil {
+		return
+	}
+	symbols := moduleKallsyms(string(kallsyms))
+	for _, name := range changed {
+		files := map[string][]byte{
+			kallsymsFile: []byte(symbols[name]),
+			modulesFile:  []byte(lines[name]),
+		}
+		if seen != 0 {
+			files[seenFile] = []byte(strconv.FormatFloat(seen, 'f', 6, 64) + "\n")
+		}
+		dir := filepath.Join(sysModuleDir, name, "sections")
+		entries, _ := ioutil.ReadDir(filepath.Join(Root, dir))
+		for _, entry := range entries {
+			data, err := ioutil.ReadFile(filepath.Join(Root, dir, entry.Name()))
+			if err == nil {
+				files[dir+"/"+entry.Name()] = data
+			}
+		}
+		layout, err := parse(files)
+		if err != nil || modules[name] == nil || layout.Modules[name] == nil {
+			continue
+		}
+		w.layouts = append(w.layouts, &Layout{Module: layout.Modules[name],
+			Kallsyms: layout.Kallsyms, Seen: seen, files: files})
+	}
+}
+
+// moduleKallsyms splits kallsyms by module, lines such as
+// "ffffffffc0a1b000 t mlx5_cmd_exec	[mlx5_core]".
+func moduleKallsyms(kallsyms string) map[string]string {
+	symbols := make(map[string]string)
+	for _, line := range strings.Split(kallsyms, "\n") {
+		end := strings.LastIndexByte(line, ']')
+		start := strings.LastIndexByte(line, '[')
+		if end != len(line)-1 || start < 0 {
+			continue
+		}
+		name := line[start+1 : end]
+		symbols[name] += line + "\n"
+	}
+	return symbols
+}
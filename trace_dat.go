@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+	"github.com/Mellanox/kmtracker/tracedat"
+	"github.com/Mellanox/kmtracker/tracefs"
+)
+
+// RecordScanner emits the MemEntry values of binary ring buffer
+// records, read from a trace.dat file or a raw dump, in timestamp order.
+type RecordScanner struct {
+	records *ftrace.Merger
+	decoder *ftrace.Decoder
+	lost    *ftrace.LostEvents
+	modules *ModuleTimeline
+	pid     int32
+	// page size of the traced kernel
+	pageSize int
+	index    int
+	entry    *MemEntry
+	err      error
+}
+
+func NewRecordScanner(records *ftrace.Merger, decoder *ftrace.Decoder,
+	pid int32, pageSize int) *RecordScanner {
+	return &RecordScanner{records: records, decoder: decoder,
+		lost: ftrace.NewLostEvents(), modules: NewModuleTimeline(), pid: pid,
+		pageSize: pageSize}
+}
+
+func (ds *RecordScanner) Scan() bool {
+	for {
+		rec, err := ds.records.Next()
+		if err != nil {
+			if err != io.EOF {
+				ds.err = err
+			}
+			ds.entry = nil
+			return false
+		}
+		ds.index++
+		if rec.Lost != nil {
+			ds.lost.Missed(*rec.Lost)
+		}
+		ds.lost.Event(rec.CPU, float64(rec.Timestamp)/1e9)
+
+		prefix, event, err := ds.decoder.Decode(rec)
+		if err != nil {
+			continue
+		}
+		if isModuleEvent(event.Name) {
+			ds.modules.Event(event, prefix.Timestamp)
+			continue
+		}
+		// negative search pid accepts entries of all processes
+		if ds.pid >= 0 && prefix.Pid != ds.pid {
+			continue
+		}
+		memEntry, err := newMemEntry(prefix, event, ds.index, ds.pageSize)
+		if err != nil {
+			continue
+		}
+		ds.entry = memEntry
+		return true
+	}
+}
+
+func (ds *RecordScanner) Entry() *MemEntry {
+	return ds.entry
+}
+
+func (ds *RecordScanner) Lost() *ftrace.LostEvents {
+	return ds.lost
+}
+
+func (ds *RecordScanner) Modules() *ModuleTimeline {
+	return ds.modules
+}
+
+func (ds *RecordScanner) Err() error {
+	return ds.err
+}
+
+// BuildMemEntriesFromDat reads a trace.dat file. The event formats and
+// kallsyms embedded in the file are used instead of the ones of the
+// running kernel.
+func BuildMemEntriesFromDat(trace_file string, pid int32, keepAll bool) (*MemEntrieByType, error) {
+	file, err := tracedat.Open(trace_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fmt.Printf("Trace options: format=trace.dat version=%d cpus=%d\n",
+		file.Version, file.CPUs)
+	schema := tracefs.NewSchema(trace_file, file.Formats)
+	for _, warning := range schema.CheckFields(requiredFields) {
+		fmt.Println("Warning:", warning)
+	}
+
+	scanner := NewRecordScanner(file.Records(), file.Decoder(), pid, file.PageSize)
+	memEntries, err := BuildMemEntriesFromSource(scanner, keepAll)
+	if err != nil {
+		return nil, err
+	}
+	memEntries.kallsyms = file.Kallsyms
+	return memEntries, nil
+}
@@ -1,35 +1,68 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+	"github.com/Mellanox/kmtracker/slabwaste"
+	"github.com/Mellanox/kmtracker/srcline"
+	"github.com/Mellanox/kmtracker/tracedat"
+	"github.com/Mellanox/kmtracker/tracefs"
 )
 
+// record saves the event formats of the traced kernel in a directory
+// with this suffix next to the trace.
+const formatsSuffix = ".tracefs"
+
 type MemEntry struct {
+	comm         string
 	pid          int32
+	tgid         int32
+	cpu          int
+	flags        ftrace.Flags
+	timestamp    float64 // seconds
 	call_type    string
 	call_site    uint64
 	call_site_fn string
-	ptr          uint64
-	length       uint64
-
-	// index in file so that we can compare
-	// free with malloc with lower index than
-	// the one found for free.
+	// offset of call_site in call_site_fn and size of the function,
+	// size is 0 when not known
+	call_site_off  uint64
+	call_site_size uint64
+	// call_site_size is estimated from the next symbol
+	call_site_estimated bool
+	// module of call_site_fn, empty for the core kernel
+	call_site_mod string
+	// source line of call_site, nil without debug info
+	call_site_loc *srcline.Location
+	ptr           uint64
+	length        uint64
+	requested     uint64 // bytes_req, 0 when not traced
+	pfn           uint64 // first page of page events
+	gfp_flags     string
+	node          int // -1 when not known
+
+	// position of the entry in the trace
 	index int
 
-	// pointer to freed entry to link to
+	// the free of an allocation or the allocation of a free
 	freeEntry *MemEntry
+	// the pointer was allocated again before a free was traced
+	free_missed bool
 }
 
 type MemEntryTracker struct {
 	size    uint64
 	count   uint64
 	entries []*MemEntry
-	ptr_map map[uint64][]*MemEntry
 	name    string
+	// entries left by the last compaction
+	compacted int
 }
 
 type MemEntrieByType struct {
@@ -40,243 +73,382 @@ type MemEntrieByType struct {
 	kmem_cache_alloc MemEntryTracker
 	kmem_cache_free  MemEntryTracker
 
-	mm_page_alloc MemEntryTracker
-	mm_page_free  MemEntryTracker
+	mm_page_alloc        MemEntryTracker
+	mm_page_free         MemEntryTracker
+	mm_page_free_batched MemEntryTracker
 
 	allocSize uint64
 	freeSize  uint64
 
 	pageAllocSize uint64
 	pageFreeSize  uint64
-}
 
-func getpid(task_pid string) int32 {
+	// kallsyms saved with the trace, empty when not available
+	kallsyms string
+	// windows in which the kernel dropped events
+	lost *ftrace.LostEvents
+	// modules loaded and unloaded while tracing
+	modules *ModuleTimeline
+	// pairs of allocations and frees
+	lifetimes *LifetimeMatcher
+	// pairs of page allocations and frees
+	pageLifetimes *LifetimeMatcher
+
+	// keep every entry of the trace, not only the allocations not
+	// freed yet
+	keepAll bool
+	// bytes requested against allocated by call site, the sites are
+	// named by the keys of siteEntries
+	waste *slabwaste.Report
+	// the site name of each call site and an allocation of it to
+	// resolve its symbol with
+	sites       map[siteKey]string
+	siteEntries map[string]*MemEntry
+}
 
-	parts := strings.Split(task_pid, "-")
-	if len(parts) != 2 {
-		return -1
+// page_alloc_bytes converts the order of a page event to bytes with
+// the page size of the traced kernel.
+// mm_page_free_batched frees single pages and has no order field.
+func page_alloc_bytes(event *ftrace.Event, pageSize int) (uint64, error) {
+	if event.Name == "mm_page_free_batched" && !event.Has("order") {
+		return uint64(pageSize), nil
 	}
-	pid, err := strconv.ParseInt(parts[1], 0, 32)
+	order, err := event.Uint("order")
 	if err != nil {
-		return -1
+		return 0, err
 	}
-	return int32(pid)
+	return uint64(pageSize) << order, nil
 }
 
-func get_uint64_value_of_key(kv string, key string, base int) (uint64, error) {
-	if strings.Contains(kv, key) == false {
-		return 0, fmt.Errorf("invalid string", kv)
-	}
+// noPfn is the pfn of a failed page allocation.
+const noPfn = ^uint64(0)
 
-	parts := strings.Split(kv, "=")
-	if len(parts) == 1 || len(parts[1]) == 0 {
-		return 0, fmt.Errorf("null value")
+// failedPageAlloc tells if a page event is a failed allocation. Binary
+// records keep the pfn of -1 while the text output prints a null page
+// with pfn 0.
+func failedPageAlloc(event *ftrace.Event, pfn uint64) bool {
+	if pfn == noPfn {
+		return true
 	}
-
-	value, err2 := strconv.ParseUint(parts[1], base, 64)
-	if err2 != nil {
-		return 0, err2
+	if pfn != 0 || event.Name != "mm_page_alloc" || !event.Has("page") {
+		return false
 	}
-	return value, nil
+	page, err := event.Uint("page")
+	return err == nil && page == 0
 }
 
-func get_call_site_addr(call_site string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(call_site, "call_site=", 16)
-	return value, err
+// requiredFields are the event fields kmtracker depends on.
+var requiredFields = map[string][]string{
+	"kmalloc":          {"call_site", "ptr", "bytes_alloc"},
+	"kmalloc_node":     {"call_site", "ptr", "bytes_alloc"},
+	"kmem_cache_alloc": {"call_site", "ptr", "bytes_alloc"},
+	"kfree":            {"call_site", "ptr"},
+	"kmem_cache_free":  {"call_site", "ptr"},
+	"mm_page_alloc":    {"pfn", "order"},
+	"mm_page_free":     {"pfn", "order"},
+
+	"mm_page_free_batched": {"pfn"},
 }
 
-func get_ptr_value(ptr string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(ptr, "ptr=", 16)
-	return value, err
-}
+// parseLine parses an event line of search_pid or a module event of
+// any process. Events of all processes are passed to lost, they tell
+// which cpus were still tracing. The prefix of events of other
+// processes is returned with the error.
+func parseLine(line string, search_pid int32, parser *ftrace.FieldParser,
+	lost *ftrace.LostEvents) (*ftrace.Prefix, *ftrace.Event, error) {
 
-func get_kmalloc_bytes(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "bytes_alloc=", 10)
-	return value, err
-}
-
-func get_kmalloc_bytes_from_line(words []string) (uint64, error) {
-
-	for _, word := range words {
-		value, err := get_kmalloc_bytes(word)
-		if err == nil {
-			return value, nil
-		}
+	prefix, body, err := ftrace.ParsePrefix(line)
+	if err != nil {
+		return nil, nil, err
 	}
-	return 0, fmt.Errorf("not found")
-}
-
-func get_mm_alloc_bytes(possible_kv string) (uint64, error) {
-
-	value, err := get_uint64_value_of_key(possible_kv, "order=", 10)
-	return value, err
-}
-
-func get_mm_alloc_bytes_from_line(words []string) (uint64, error) {
+	lost.Event(prefix.CPU, prefix.Timestamp)
 
-	for _, word := range words {
-		value, err := get_mm_alloc_bytes(word)
-		if err == nil {
-			return (value + 1) * uint64(os.Getpagesize()), nil
-		}
+	// negative search pid accepts entries of all processes
+	if search_pid >= 0 && prefix.Pid != search_pid &&
+		!isModuleEvent(eventName(body)) {
+		return prefix, nil, fmt.Errorf("pid mismatch")
 	}
-	return 0, fmt.Errorf("not found")
-}
-
-func parseLine(line string, index int, search_pid int32) (*MemEntry, error) {
 
-	line = strings.TrimLeft(line, " ")
-	if len(line) == 0 {
-		return nil, fmt.Errorf("short line")
+	event, err := parser.ParseEvent(body)
+	if err != nil {
+		return nil, nil, err
 	}
+	return prefix, event, nil
+}
 
-	words := strings.Split(line, " ")
-	pid := getpid(words[0])
-
-	if pid != search_pid {
-		return nil, fmt.Errorf("pid mismatch")
+// eventName returns the name of the event part of a trace line.
+func eventName(body string) string {
+	if i := strings.IndexByte(body, ':'); i > 0 {
+		return body[:i]
 	}
+	return ""
+}
 
-	valid_kv := make([]string, 0)
+// newMemEntry builds the MemEntry of a parsed event. index is the
+// position of the event in the trace.
+func newMemEntry(prefix *ftrace.Prefix, event *ftrace.Event, index int,
+	pageSize int) (*MemEntry, error) {
+	var err error
 
-	for _, word := range words {
-		if len(word) == 0 || word == " " || word == "(null)" {
-			continue
-		}
-		//fmt.Println(valid_kv)
-		valid_kv = append(valid_kv, word)
+	memEntry := new(MemEntry)
+	memEntry.comm = prefix.Comm
+	memEntry.pid = prefix.Pid
+	memEntry.tgid = prefix.Tgid
+	memEntry.cpu = prefix.CPU
+	memEntry.flags = prefix.Flags
+	memEntry.timestamp = prefix.Timestamp
+	memEntry.call_type = event.Name
+	memEntry.index = index
+	memEntry.call_site, _ = event.Uint("call_site")
+	// kernels printing call_site with %pS already give the function
+	if ref := event.Symbol("call_site"); ref != nil {
+		memEntry.call_site_fn = ref.Name
+		memEntry.call_site_off = ref.Offset
+		memEntry.call_site_size = ref.Size
+		memEntry.call_site_mod = ref.Module
 	}
-	if len(valid_kv) < 4 {
-		return nil, fmt.Errorf("short line")
+	memEntry.ptr, _ = event.Uint("ptr")
+	memEntry.gfp_flags = event.String("gfp_flags")
+	memEntry.node = -1
+	if node, err := event.Int("node"); err == nil {
+		memEntry.node = int(node)
 	}
 
-	//remove pid, cpu, state, time
-	valid_kv = valid_kv[4:]
-	//fmt.Println(pid, len(valid_kv), valid_kv)
-
-	addr, _ := get_call_site_addr(valid_kv[1])
-	ptr, _ := get_ptr_value(valid_kv[2])
-	memEntry := new(MemEntry)
-	memEntry.pid = pid
-	memEntry.call_type = strings.TrimRight(valid_kv[0], ":")
-	memEntry.call_site = addr
-	memEntry.ptr = ptr
-	memEntry.index = index
-	/*
-		if ptr != 0 {
-			fmt.Printf("type = %v ptr = 0x%x\n ", memEntry.call_type, ptr)
-		}
-	*/
-
-	if memEntry.call_type == "kmalloc" ||
-		memEntry.call_type == "kmalloc_node" ||
-		memEntry.call_type == "kmem_cache_alloc" {
-		length, len_err := get_kmalloc_bytes_from_line(valid_kv)
-		if len_err != nil {
-			return nil, len_err
-		}
-		memEntry.length = length
-	} else if memEntry.call_type == "mm_page_alloc" {
-		length, len_err := get_mm_alloc_bytes_from_line(valid_kv)
-		if len_err != nil {
-			return nil, len_err
+	switch memEntry.call_type {
+	case "kmalloc", "kmalloc_node", "kmem_cache_alloc":
+		memEntry.requested, _ = event.Uint("bytes_req")
+		memEntry.length, err = event.Uint("bytes_alloc")
+	case "mm_page_alloc", "mm_page_free", "mm_page_free_batched":
+		memEntry.pfn, err = event.Uint("pfn")
+		if err != nil {
+			return nil, err
 		}
-		memEntry.length = length
-	} else if memEntry.call_type == "mm_page_free" {
-		length, len_err := get_mm_alloc_bytes_from_line(valid_kv)
-		if len_err != nil {
-			return nil, len_err
+		if failedPageAlloc(event, memEntry.pfn) {
+			memEntry.pfn = noPfn
 		}
-		memEntry.length = length
+		memEntry.length, err = page_alloc_bytes(event, pageSize)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return memEntry, nil
 }
 
 func IntMemTracker(tracker *MemEntryTracker, name string) {
 	tracker.name = name
-	tracker.ptr_map = make(map[uint64][]*MemEntry)
 }
 
-func LinkFreeEntryToAlloc(memEntries *MemEntrieByType,
-	mallocTracker *MemEntryTracker, freeEntry *MemEntry) uint64 {
-	var malloc_len uint64
-	var i int
+// TraceScanner reads a text trace as a stream of lines and emits the
+// MemEntry of every line that belongs to the searched pid. It works on
+// any io.Reader so traces larger than memory can be read from a file,
+// stdin or a pipe.
+type TraceScanner struct {
+	scanner *bufio.Scanner
+	parser  *ftrace.FieldParser
+	pid     int32
+	index   int
+	entry   *MemEntry
+	header  ftrace.Header
+	lost    *ftrace.LostEvents
+	modules *ModuleTimeline
+
+	// page allocation of each cpu a stacktrace trigger entry may follow,
+	// until another event of the cpu comes first
+	pageAllocs map[int]*MemEntry
+	// page allocation the frames read belong to
+	stackEntry *MemEntry
+	frames     []*ftrace.SymbolRef
+
+	// schema of the traced kernel, nil when not available
+	schema *tracefs.Schema
+	// page size of the traced kernel
+	pageSize int
+	// events already compared with the schema
+	checked  map[string]bool
+	warnings []string
+}
 
-	if len(mallocTracker.ptr_map[freeEntry.ptr]) == 0 {
-		return 0
+// NewTraceScanner returns a scanner for r. schema holds the event
+// formats and page size of the traced kernel used to type and validate
+// the event fields, it may be nil.
+func NewTraceScanner(r io.Reader, pid int32, schema *tracefs.Schema) *TraceScanner {
+	var formats map[string]*ftrace.EventFormat
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	pageSize := tracefs.DefaultPageSize
+	if schema != nil {
+		formats = schema.Events
+		pageSize = schema.PageSize
 	}
+	return &TraceScanner{scanner: scanner, pid: pid, schema: schema,
+		pageSize:   pageSize,
+		parser:     ftrace.NewFieldParser(formats),
+		lost:       ftrace.NewLostEvents(),
+		modules:    NewModuleTimeline(),
+		pageAllocs: make(map[int]*MemEntry),
+		checked:    make(map[string]bool)}
+}
 
-	for i = 0; i < len(mallocTracker.ptr_map[freeEntry.ptr]); i++ {
-		if freeEntry.index <
-			mallocTracker.ptr_map[freeEntry.ptr][i].index {
-			// if the index of the kfree in the file is
-			// smaller than the index of allocated entry
-			// it means that we need to skip such free
-			// entry, because we are interested in finding
-			// match for kfree done after a previous kmalloc
-			// in a time scale
-			continue
+// stackLine handles the lines of a stack trace entry, it returns false
+// for other lines. The stack of a page allocation of the searched pid
+// sets its call site.
+func (ts *TraceScanner) stackLine(line string) bool {
+	if frame, ok := ftrace.ParseStackLine(line); ok {
+		if ts.stackEntry != nil {
+			ts.frames = append(ts.frames, frame)
 		}
-		malloc_len = mallocTracker.ptr_map[freeEntry.ptr][i].length
-		mallocTracker.ptr_map[freeEntry.ptr][i].freeEntry = freeEntry
-		freeEntry.freeEntry = mallocTracker.ptr_map[freeEntry.ptr][i]
-		break
+		return true
+	}
+	ts.endStack()
+	if !strings.Contains(line, ftrace.StackTraceEvent) {
+		return false
 	}
 
-	return malloc_len
+	prefix, body, err := ftrace.ParsePrefix(line)
+	if err != nil || strings.TrimSpace(body) != ftrace.StackTraceEvent {
+		return false
+	}
+	// the trigger may stamp the stack a little later than the event
+	entry := ts.pageAllocs[prefix.CPU]
+	if entry != nil && entry.pid == prefix.Pid {
+		ts.stackEntry = entry
+	}
+	delete(ts.pageAllocs, prefix.CPU)
+	return true
 }
 
-func linkFreeToAlloc(memEntries *MemEntrieByType) {
+func (ts *TraceScanner) endStack() {
+	if ts.stackEntry != nil {
+		setStackCallSite(ts.stackEntry, ts.frames)
+	}
+	ts.stackEntry = nil
+	ts.frames = nil
+}
 
-	var freeTracker *MemEntryTracker
+// check compares the first event of each type with the schema.
+func (ts *TraceScanner) check(event *ftrace.Event) {
+	if ts.schema == nil || ts.checked[event.Name] {
+		return
+	}
+	ts.checked[event.Name] = true
+	if err := ts.schema.CheckEvent(event); err != nil {
+		ts.warnings = append(ts.warnings, err.Error())
+	}
+}
 
-	freeTracker = &memEntries.kfree
-	for _, freeentry := range freeTracker.entries {
-		if freeentry.ptr == 0 {
-			//kfree with zero is valid in kernel
+// Scan advances to the next MemEntry, skipping lines which cannot be
+// parsed. It returns false at the end of input or on a read error.
+func (ts *TraceScanner) Scan() bool {
+	for ts.scanner.Scan() {
+		ts.index++
+		if cpu, count, ok := ftrace.ParseLostLine(ts.scanner.Text()); ok {
+			ts.lost.Lost(cpu, count)
 			continue
 		}
-		len := LinkFreeEntryToAlloc(memEntries, &memEntries.kmalloc, freeentry)
-		if len == 0 {
-			len = LinkFreeEntryToAlloc(memEntries,
-				&memEntries.kmalloc_node, freeentry)
-		} else {
-			freeentry.length = len
+		if ts.header.ParseLine(ts.scanner.Text()) {
+			continue
+		}
+		if ts.stackLine(ts.scanner.Text()) {
+			continue
 		}
-		if len != 0 {
-			freeentry.length = len
-			freeTracker.size += len
-			memEntries.freeSize += len
+		prefix, event, err := parseLine(ts.scanner.Text(), ts.pid, ts.parser, ts.lost)
+		if prefix != nil {
+			// the stack of a page allocation follows it directly
+			delete(ts.pageAllocs, prefix.CPU)
 		}
+		if err != nil {
+			continue
+		}
+		ts.check(event)
+		if isModuleEvent(event.Name) {
+			ts.modules.Event(event, prefix.Timestamp)
+			continue
+		}
+		memEntry, err := newMemEntry(prefix, event, ts.index, ts.pageSize)
+		if err != nil {
+			continue
+		}
+		if memEntry.call_type == "mm_page_alloc" {
+			ts.pageAllocs[memEntry.cpu] = memEntry
+		}
+		ts.entry = memEntry
+		return true
 	}
+	ts.endStack()
+	ts.entry = nil
+	return false
+}
+
+func (ts *TraceScanner) Entry() *MemEntry {
+	return ts.entry
 }
 
-func linkCacheFreeToAlloc(memEntries *MemEntrieByType) {
+// Header returns the trace options detected so far.
+func (ts *TraceScanner) Header() *ftrace.Header {
+	return &ts.header
+}
 
-	var freeTracker *MemEntryTracker
+// Lost returns the event losses found so far.
+func (ts *TraceScanner) Lost() *ftrace.LostEvents {
+	return ts.lost
+}
+
+// Modules returns the module loads found so far.
+func (ts *TraceScanner) Modules() *ModuleTimeline {
+	return ts.modules
+}
+
+// Warnings returns the differences found between the trace and the
+// schema.
+func (ts *TraceScanner) Warnings() []string {
+	return ts.warnings
+}
+
+func (ts *TraceScanner) Err() error {
+	return ts.scanner.Err()
+}
 
-	freeTracker = &memEntries.kmem_cache_free
-	for _, freeentry := range freeTracker.entries {
-		if freeentry.ptr == 0 {
-			//kfree with zero is valid in kernel
+// LoadTraceSchema loads the kmem event formats for a trace. formats is
+// a tracefs root or saved copy given by the user. Without it the copy
+// saved by record next to the trace is used, then the running kernel.
+// Missing fields kmtracker depends on are reported as warnings.
+func LoadTraceSchema(trace_file string, formats string) *tracefs.Schema {
+	var roots []string
+
+	if len(formats) != 0 {
+		roots = append(roots, formats)
+	} else {
+		if len(trace_file) != 0 && trace_file != "-" {
+			roots = append(roots, trace_file+formatsSuffix)
+		}
+		roots = append(roots, tracefs.DefaultRoot)
+	}
+
+	for _, root := range roots {
+		schema, err := tracefs.LoadSchema(root, "kmem", "module")
+		if err != nil {
 			continue
 		}
-		len := LinkFreeEntryToAlloc(memEntries, &memEntries.kmem_cache_alloc, freeentry)
-		if len != 0 {
-			freeentry.length = len
-			freeTracker.size += len
-			memEntries.freeSize += len
+		fmt.Println("Using event formats from", root)
+		for _, warning := range schema.CheckFields(requiredFields) {
+			fmt.Println("Warning:", warning)
 		}
+		return schema
 	}
+	fmt.Println("Warning: event formats not found, trace fields are not validated")
+	return nil
 }
 
-func BuildMemEntries(trace_file string, pid int32) (*MemEntrieByType, error) {
-
-	var tracker *MemEntryTracker
+// OpenTrace opens a trace file for reading, "-" reads from stdin.
+func OpenTrace(trace_file string) (io.ReadCloser, error) {
+	if trace_file == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(trace_file)
+}
 
+func NewMemEntries() *MemEntrieByType {
 	memEntries := new(MemEntrieByType)
 	IntMemTracker(&memEntries.kmalloc, "kmalloc")
 	IntMemTracker(&memEntries.kmalloc_node, "kmalloc_node")
@@ -285,75 +457,229 @@ func BuildMemEntries(trace_file string, pid int32) (*MemEntrieByType, error) {
 	IntMemTracker(&memEntries.kmem_cache_free, "kmem_cache_free")
 	IntMemTracker(&memEntries.mm_page_alloc, "mm_page_alloc")
 	IntMemTracker(&memEntries.mm_page_free, "mm_page_free")
+	IntMemTracker(&memEntries.mm_page_free_batched, "mm_page_free_batched")
+	return memEntries
+}
 
-	file := FileObject{trace_file, nil}
-
-	data, err := file.Read()
-	if err != nil {
-		fmt.Println("Fail to read file")
-		return nil, err
+// compactEntries drops the allocations freed from tracker.
+func compactEntries(tracker *MemEntryTracker) {
+	live := tracker.entries[:0]
+	for _, e := range tracker.entries {
+		if e.freeEntry == nil && !e.free_missed {
+			live = append(live, e)
+		}
+	}
+	for i := len(live); i < len(tracker.entries); i++ {
+		tracker.entries[i] = nil
 	}
-	lines := strings.Split(data, "\n")
-	//skip first 11 lines
-	offset := 11
-	lines = lines[offset:]
+	tracker.entries = live
+	tracker.compacted = len(live)
+}
 
-	for i, line := range lines {
-		memEntry, err := parseLine(line, i+offset+1, pid)
-		if err != nil {
-			continue
+// store keeps an entry in its tracker. Unless all entries are kept,
+// frees are not stored and allocations freed are dropped as the
+// tracker grows.
+func (memEntries *MemEntrieByType) store(tracker *MemEntryTracker, memEntry *MemEntry) {
+	if !memEntries.keepAll {
+		if len(allocFamily(memEntry.call_type)) == 0 {
+			return
+		}
+		if len(tracker.entries) >= 2*tracker.compacted+1024 {
+			compactEntries(tracker)
 		}
+	}
+	tracker.entries = append(tracker.entries, memEntry)
+}
 
+// addWaste adds an allocation to the waste of its call site.
+func (memEntries *MemEntrieByType) addWaste(memEntry *MemEntry) {
+	key := siteKey{call_site: memEntry.call_site, fn: memEntry.call_site_fn,
+		off: memEntry.call_site_off}
+	if memEntries.modules != nil {
+		key.moduleEvents = memEntries.modules.events
+	}
+	site, ok := memEntries.sites[key]
+	if !ok {
+		site = strconv.Itoa(len(memEntries.sites))
+		memEntries.sites[key] = site
+		memEntries.siteEntries[site] = memEntry
+	}
+	memEntries.waste.Add(site, memEntry.call_type != "kmem_cache_alloc",
+		memEntry.requested, memEntry.length)
+}
+
+// AddEntry accounts a single parsed entry to its tracker.
+func (memEntries *MemEntrieByType) AddEntry(memEntry *MemEntry) {
+	var tracker *MemEntryTracker
+
+	switch memEntry.call_type {
+	case "kmalloc":
+		tracker = &memEntries.kmalloc
+	case "kmalloc_node":
+		tracker = &memEntries.kmalloc_node
+	case "kfree":
+		tracker = &memEntries.kfree
+	case "kmem_cache_alloc":
+		tracker = &memEntries.kmem_cache_alloc
+	case "kmem_cache_free":
+		tracker = &memEntries.kmem_cache_free
+	case "mm_page_alloc":
+		tracker = &memEntries.mm_page_alloc
+	case "mm_page_free":
+		tracker = &memEntries.mm_page_free
+	case "mm_page_free_batched":
+		tracker = &memEntries.mm_page_free_batched
+	default:
+		tracker = nil
+	}
+	if tracker == nil {
+		return
+	}
+	if isPageEvent(memEntry.call_type) {
+		if memEntry.pfn == noPfn {
+			return
+		}
+		tracker.count++
+		tracker.size += memEntry.length
+		memEntries.store(tracker, memEntry)
+		if memEntry.call_type == "mm_page_alloc" {
+			memEntries.pageAllocSize += memEntry.length
+		} else {
+			memEntries.pageFreeSize += memEntry.length
+		}
+	} else if memEntry.ptr != 0 {
+		tracker.count++
+		tracker.size += memEntry.length
+		memEntries.store(tracker, memEntry)
 		switch memEntry.call_type {
 		case "kmalloc":
-			tracker = &memEntries.kmalloc
+			memEntries.allocSize += memEntry.length
 		case "kmalloc_node":
-			tracker = &memEntries.kmalloc_node
-		case "kfree":
-			tracker = &memEntries.kfree
+			memEntries.allocSize += memEntry.length
 		case "kmem_cache_alloc":
-			tracker = &memEntries.kmem_cache_alloc
-		case "kmem_cache_free":
-			tracker = &memEntries.kmem_cache_free
-		case "mm_page_alloc":
-			tracker = &memEntries.mm_page_alloc
-		case "mm_page_free":
-			tracker = &memEntries.mm_page_free
-		default:
-			tracker = nil
+			memEntries.allocSize += memEntry.length
 		}
-		if tracker == nil {
-			continue
+		if memEntries.waste != nil && len(allocFamily(memEntry.call_type)) != 0 {
+			memEntries.addWaste(memEntry)
 		}
-		if memEntry.ptr != 0 {
-			tracker.count++
-			tracker.size += memEntry.length
-			tracker.entries = append(tracker.entries, memEntry)
-			tracker.ptr_map[memEntry.ptr] =
-				append(tracker.ptr_map[memEntry.ptr], memEntry)
-			switch memEntry.call_type {
-			case "kmalloc":
-				memEntries.allocSize += memEntry.length
-			case "kmalloc_node":
-				memEntries.allocSize += memEntry.length
-			case "kmem_cache_alloc":
-				memEntries.allocSize += memEntry.length
-			}
-		} else {
-			if memEntry.call_type == "mm_page_alloc" {
-				tracker.count++
-				tracker.size += memEntry.length
-				memEntries.pageAllocSize += memEntry.length
-			} else if memEntry.call_type == "mm_page_free" {
-				tracker.count++
-				tracker.size += memEntry.length
-				memEntries.pageFreeSize += memEntry.length
-			}
+	}
+}
+
+// Add accounts an entry of the trace and pairs it with its allocation
+// or free as it arrives. Page frees keep their own size, the page
+// totals are those of the events.
+func (memEntries *MemEntrieByType) Add(memEntry *MemEntry) {
+	memEntries.AddEntry(memEntry)
+	if isPageEvent(memEntry.call_type) {
+		memEntries.pageLifetimes.Add(memEntry)
+		return
+	}
+	if alloc := memEntries.lifetimes.Add(memEntry); alloc != nil {
+		memEntries.accountFree(memEntry, alloc)
+	}
+}
+
+// EntrySource is a stream of MemEntry values such as a text or a
+// binary trace.
+type EntrySource interface {
+	Scan() bool
+	Entry() *MemEntry
+	Lost() *ftrace.LostEvents
+	Modules() *ModuleTimeline
+	Err() error
+}
+
+// BuildMemEntriesFromSource accounts all entries of src and pairs free
+// entries with their allocations while the trace is read. Only the
+// allocations not freed are kept unless keepAll is set, the entries of
+// the verbose listings.
+func BuildMemEntriesFromSource(src EntrySource, keepAll bool) (*MemEntrieByType, error) {
+
+	memEntries := NewMemEntries()
+	memEntries.keepAll = keepAll
+	memEntries.lifetimes = NewLifetimeMatcher(keepAll)
+	memEntries.pageLifetimes = NewLifetimeMatcher(keepAll)
+	memEntries.waste = slabwaste.New()
+	memEntries.sites = make(map[siteKey]string)
+	memEntries.siteEntries = make(map[string]*MemEntry)
+	memEntries.modules = src.Modules()
+
+	for src.Scan() {
+		memEntries.Add(src.Entry())
+	}
+	if err := src.Err(); err != nil {
+		return nil, err
+	}
+	memEntries.lost = src.Lost()
+
+	if !keepAll {
+		for _, tracker := range []*MemEntryTracker{&memEntries.kmalloc,
+			&memEntries.kmalloc_node, &memEntries.kmem_cache_alloc,
+			&memEntries.mm_page_alloc} {
+			compactEntries(tracker)
 		}
 	}
+	return memEntries, nil
+}
 
-	linkFreeToAlloc(memEntries)
-	linkCacheFreeToAlloc(memEntries)
+// addStatsLosses adds the events the cpu stats saved in dir count as
+// overwritten or dropped to the lost windows.
+func addStatsLosses(memEntries *MemEntrieByType, dir string) {
+	for _, stats := range tracefs.LoadStats(dir) {
+		if stats.Overrun != 0 {
+			memEntries.lost.Overrun(stats.CPU, stats.Overrun)
+		}
+		if stats.Dropped != 0 {
+			memEntries.lost.Dropped(stats.CPU, stats.Dropped)
+		}
+	}
+}
+
+// BuildMemEntriesFromReader streams a text trace from r.
+func BuildMemEntriesFromReader(r io.Reader, pid int32,
+	schema *tracefs.Schema, keepAll bool) (*MemEntrieByType, error) {
 
+	scanner := NewTraceScanner(r, pid, schema)
+	memEntries, err := BuildMemEntriesFromSource(scanner, keepAll)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Trace options:", scanner.Header())
+	for _, warning := range scanner.Warnings() {
+		fmt.Println("Warning:", warning)
+	}
+	return memEntries, nil
+}
+
+// BuildMemEntries reads a text trace, a trace-cmd trace.dat file or a
+// raw dump directory written by record --raw.
+// formats is the tracefs root or saved copy with the event formats of
+// a text trace, see LoadTraceSchema. keepAll keeps every entry instead
+// of the allocations not freed only.
+func BuildMemEntries(trace_file string, pid int32,
+	formats string, keepAll bool) (*MemEntrieByType, error) {
+
+	if trace_file != "-" && tracedat.IsTraceDat(trace_file) {
+		return BuildMemEntriesFromDat(trace_file, pid, keepAll)
+	}
+	if tracefs.IsRawDump(trace_file) {
+		return BuildMemEntriesFromRaw(trace_file, pid, keepAll)
+	}
+
+	file, err := OpenTrace(trace_file)
+	if err != nil {
+		fmt.Println("Fail to read file")
+		return nil, err
+	}
+	defer file.Close()
+
+	memEntries, err := BuildMemEntriesFromReader(file, pid,
+		LoadTraceSchema(trace_file, formats), keepAll)
+	if err != nil {
+		return nil, err
+	}
+	if trace_file != "-" {
+		addStatsLosses(memEntries, trace_file+formatsSuffix)
+	}
 	return memEntries, nil
 }
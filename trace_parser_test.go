@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Mellanox/kmtracker/tracefs"
+)
+
+func TestFailedPageAllocText(t *testing.T) {
+	file, err := os.Open("testdata/failed_page.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	memEntries, err := BuildMemEntriesFromReader(file, 1234, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memEntries.mm_page_alloc.count != 1 || memEntries.mm_page_free.count != 1 {
+		t.Fatalf("page allocs %v frees %v, want 1 and 1",
+			memEntries.mm_page_alloc.count, memEntries.mm_page_free.count)
+	}
+	if memEntries.pageAllocSize != memEntries.pageFreeSize {
+		t.Errorf("page alloc size %v, free size %v",
+			memEntries.pageAllocSize, memEntries.pageFreeSize)
+	}
+	pm := memEntries.pageLifetimes
+	if len(pm.missedFrees) != 0 || len(pm.unknownFrees) != 0 || len(pm.live) != 0 {
+		t.Errorf("missed frees %v, unknown frees %v, outstanding %v, want none",
+			len(pm.missedFrees), len(pm.unknownFrees), len(pm.live))
+	}
+}
+
+func TestPageSizeOfTrace(t *testing.T) {
+	file, err := os.Open("testdata/failed_page.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	schema := &tracefs.Schema{PageSize: 65536}
+	memEntries, err := BuildMemEntriesFromReader(file, 1234, schema, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memEntries.pageAllocSize != 65536 {
+		t.Errorf("page alloc size %v, want 65536", memEntries.pageAllocSize)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Mellanox/kmtracker/tracefs"
+)
+
+// BuildMemEntriesFromRaw reads a dump of the per cpu binary ring
+// buffers saved by record --raw. The dump holds the event formats and
+// page layout of the traced kernel.
+func BuildMemEntriesFromRaw(dump_dir string, pid int32, keepAll bool) (*MemEntrieByType, error) {
+	raw, err := tracefs.OpenRaw(dump_dir, "kmem", "module")
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	fmt.Printf("Trace options: format=raw cpus=%d\n", len(raw.CPUs))
+	for _, warning := range raw.Schema.CheckFields(requiredFields) {
+		fmt.Println("Warning:", warning)
+	}
+	scanner := NewRecordScanner(raw.Records(), raw.Decoder(), pid, raw.PageSize)
+	memEntries, err := BuildMemEntriesFromSource(scanner, keepAll)
+	if err != nil {
+		return nil, err
+	}
+	addStatsLosses(memEntries, dump_dir)
+	return memEntries, nil
+}
@@ -0,0 +1,306 @@
+// Package tracedat reads the binary trace.dat files written by
+// trace-cmd record (file format version 6).
+package tracedat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+)
+
+var magic = []byte{0x17, 0x08, 0x44, 't', 'r', 'a', 'c', 'i', 'n', 'g'}
+
+// cpuData is the location of the ring buffer pages of one cpu.
+type cpuData struct {
+	offset int64
+	size   int64
+}
+
+// File is an open trace.dat file.
+type File struct {
+	file *os.File
+
+	Version  int
+	Order    binary.ByteOrder
+	LongSize int
+	PageSize int
+
+	PageHeader *ftrace.PageHeader
+	// formats of all events stored in the file
+	Formats []*ftrace.EventFormat
+	// content of /proc/kallsyms at record time
+	Kallsyms string
+	// pid to task name
+	Comms map[int32]string
+	CPUs  int
+
+	cpus []cpuData
+	// readers of the last Records call
+	readers []*ftrace.CPUReader
+}
+
+// IsTraceDat reports whether the file at path starts with the
+// trace.dat magic.
+func IsTraceDat(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	buf := make([]byte, len(magic))
+	_, err = io.ReadFull(file, buf)
+	return err == nil && bytes.Equal(buf, magic)
+}
+
+type reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *reader) bytes(n int64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, buf)
+	return buf
+}
+
+func (r *reader) u8() uint8 {
+	b := r.bytes(1)
+	if r.err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) u16() uint16 {
+	b := r.bytes(2)
+	if r.err != nil {
+		return 0
+	}
+	return r.order.Uint16(b)
+}
+
+func (r *reader) u32() uint32 {
+	b := r.bytes(4)
+	if r.err != nil {
+		return 0
+	}
+	return r.order.Uint32(b)
+}
+
+func (r *reader) u64() uint64 {
+	b := r.bytes(8)
+	if r.err != nil {
+		return 0
+	}
+	return r.order.Uint64(b)
+}
+
+// cstring reads a nul terminated string.
+func (r *reader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	s, err := r.r.ReadString(0)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+	return s[:len(s)-1]
+}
+
+// section reads a size prefixed block, sizeLen is 4 or 8 bytes.
+func (r *reader) section(sizeLen int) []byte {
+	var size uint64
+
+	if sizeLen == 4 {
+		size = uint64(r.u32())
+	} else {
+		size = r.u64()
+	}
+	if r.err != nil {
+		return nil
+	}
+	if size > 1<<32 {
+		r.err = fmt.Errorf("invalid section size %d", size)
+		return nil
+	}
+	return r.bytes(int64(size))
+}
+
+func (r *reader) formats(count uint32, system string) []*ftrace.EventFormat {
+	var formats []*ftrace.EventFormat
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		data := r.section(8)
+		if r.err != nil {
+			break
+		}
+		format, err := ftrace.ParseFormat(bytes.NewReader(data))
+		if err != nil {
+			// not an event kmtracker can decode
+			continue
+		}
+		format.System = system
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// Open reads the headers of a trace.dat file.
+func Open(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseHeaders(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	f.file = file
+	return f, nil
+}
+
+func parseHeaders(file *os.File) (*File, error) {
+	f := new(File)
+	r := &reader{r: bufio.NewReader(file), order: binary.LittleEndian}
+
+	if !bytes.Equal(r.bytes(int64(len(magic))), magic) {
+		return nil, fmt.Errorf("not a trace.dat file")
+	}
+	version, err := strconv.Atoi(r.cstring())
+	if err != nil {
+		return nil, fmt.Errorf("invalid version")
+	}
+	if version != 6 {
+		return nil, fmt.Errorf("trace.dat version %d is not supported", version)
+	}
+	f.Version = version
+
+	if r.u8() == 1 {
+		r.order = binary.BigEndian
+	}
+	f.Order = r.order
+	f.LongSize = int(r.u8())
+	f.PageSize = int(r.u32())
+
+	if r.cstring() != "header_page" {
+		return nil, fmt.Errorf("header_page not found")
+	}
+	headerPage := r.section(8)
+	if r.cstring() != "header_event" {
+		return nil, fmt.Errorf("header_event not found")
+	}
+	r.section(8)
+	if r.err != nil {
+		return nil, r.err
+	}
+	f.PageHeader, err = ftrace.ParsePageHeader(string(headerPage))
+	if err != nil {
+		f.PageHeader = ftrace.DefaultPageHeader(f.LongSize)
+	}
+
+	f.Formats = r.formats(r.u32(), "ftrace")
+	systems := r.u32()
+	for i := uint32(0); i < systems && r.err == nil; i++ {
+		system := r.cstring()
+		f.Formats = append(f.Formats, r.formats(r.u32(), system)...)
+	}
+
+	f.Kallsyms = string(r.section(4))
+	r.section(4) // printk formats
+	f.Comms = ftrace.ParseCmdlines(string(r.section(8)))
+	f.CPUs = int(r.u32())
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for {
+		id := r.bytes(10)
+		if r.err != nil {
+			return nil, r.err
+		}
+		switch string(bytes.TrimRight(id, "\x00 ")) {
+		case "options":
+			r.options()
+		case "latency":
+			return nil, fmt.Errorf("latency tracer data is not supported")
+		case "flyrecord":
+			for cpu := 0; cpu < f.CPUs; cpu++ {
+				f.cpus = append(f.cpus, cpuData{offset: int64(r.u64()),
+					size: int64(r.u64())})
+			}
+			return f, r.err
+		default:
+			return nil, fmt.Errorf("unknown section %q", id)
+		}
+	}
+}
+
+// options skips the options section, a list of id, size and data
+// terminated by id 0.
+func (r *reader) options() {
+	for r.err == nil {
+		id := r.u16()
+		if r.err != nil || id == 0 {
+			return
+		}
+		r.bytes(int64(r.u32()))
+	}
+}
+
+// Records returns a reader of all events of the file merged by
+// timestamp.
+func (f *File) Records() *ftrace.Merger {
+	var readers []ftrace.RecordReader
+
+	f.readers = nil
+	for cpu, data := range f.cpus {
+		section := io.NewSectionReader(f.file, data.offset, data.size)
+		cr := ftrace.NewCPUReader(cpu, section, f.Order, f.PageSize, f.PageHeader)
+		f.readers = append(f.readers, cr)
+		readers = append(readers, cr)
+	}
+	return ftrace.NewMerger(readers...)
+}
+
+// Missed returns the event losses seen by the readers of the last
+// Records call.
+func (f *File) Missed() []ftrace.Lost {
+	var missed []ftrace.Lost
+
+	for _, cr := range f.readers {
+		missed = append(missed, cr.Missed()...)
+	}
+	return missed
+}
+
+// Decoder returns a decoder for the records of the file.
+func (f *File) Decoder() *ftrace.Decoder {
+	return ftrace.NewDecoder(f.Order, f.Formats, f.Comms)
+}
+
+// Format returns the format of the named event.
+func (f *File) Format(name string) *ftrace.EventFormat {
+	for _, format := range f.Formats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	return f.file.Close()
+}
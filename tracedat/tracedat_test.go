@@ -0,0 +1,84 @@
+package tracedat
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/trace.dat is a version 6 file of a little endian host with
+// a kmalloc and a kfree on cpu0 and a kmalloc after missed events on
+// cpu1.
+func TestOpen(t *testing.T) {
+	if !IsTraceDat("testdata/trace.dat") {
+		t.Fatal("trace.dat magic not found")
+	}
+	f, err := Open("testdata/trace.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Version != 6 || f.Order != binary.LittleEndian || f.LongSize != 8 ||
+		f.PageSize != 4096 || f.CPUs != 2 {
+		t.Errorf("version %v order %v long size %v page size %v cpus %v",
+			f.Version, f.Order, f.LongSize, f.PageSize, f.CPUs)
+	}
+	if f.PageHeader.CommitOffset != 8 || f.PageHeader.DataOffset != 16 ||
+		f.PageHeader.PageSize != 4096 {
+		t.Errorf("page header %+v", f.PageHeader)
+	}
+	if f.Format("kmalloc") == nil || f.Format("kfree") == nil {
+		t.Errorf("kmem formats not found")
+	}
+	if !strings.Contains(f.Kallsyms, "mlx5_cmd_exec") {
+		t.Errorf("kallsyms %q", f.Kallsyms)
+	}
+	if f.Comms[1234] != "ibv_rc" {
+		t.Errorf("comms %v", f.Comms)
+	}
+
+	var names []string
+	records := f.Records()
+	decoder := f.Decoder()
+	for {
+		rec, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, event, err := decoder.Decode(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, event.Name)
+	}
+	if strings.Join(names, " ") != "kmalloc kmalloc kfree" {
+		t.Errorf("events %v", names)
+	}
+	if missed := f.Missed(); len(missed) != 1 || missed[0].CPU != 1 {
+		t.Errorf("missed %v, want one loss on cpu1", missed)
+	}
+}
+
+func TestOpenTruncated(t *testing.T) {
+	data, err := os.ReadFile("testdata/trace.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut inside the header_page section
+	path := filepath.Join(t.TempDir(), "trace.dat")
+	err = os.WriteFile(path, data[:40], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := Open(path); err == nil {
+		f.Close()
+		t.Errorf("truncated trace.dat opened without error")
+	}
+}
@@ -0,0 +1,296 @@
+package tracefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+)
+
+// RawTrace reads the binary per cpu ring buffers, per_cpu/cpuN/trace_pipe_raw,
+// of a dump saved by DumpRaw. A dump has the tracefs layout so it also
+// holds the page header, event formats and saved_cmdlines of the
+// traced kernel.
+type RawTrace struct {
+	Root       string
+	Schema     *Schema
+	PageHeader *ftrace.PageHeader
+	// page size and byte order of the traced host
+	PageSize  int
+	ByteOrder binary.ByteOrder
+	Comms     map[int32]string
+	// cpus with a buffer in the dump
+	CPUs []int
+
+	files   []*os.File
+	readers []*ftrace.CPUReader
+}
+
+func rawPath(root string, cpu int) string {
+	return filepath.Join(root, "per_cpu", fmt.Sprintf("cpu%d", cpu), "trace_pipe_raw")
+}
+
+// rawCPUs returns the cpus having a trace_pipe_raw file below root.
+func rawCPUs(root string) []int {
+	var cpus []int
+
+	paths, _ := filepath.Glob(filepath.Join(root, "per_cpu", "cpu*", "trace_pipe_raw"))
+	for _, path := range paths {
+		name := filepath.Base(filepath.Dir(path))
+		cpu, err := strconv.Atoi(strings.TrimPrefix(name, "cpu"))
+		if err != nil {
+			continue
+		}
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus
+}
+
+// rawInfoFile of a dump holds the page size and byte order of the
+// traced host, which the formats of the dump do not tell.
+const rawInfoFile = "raw_info"
+
+func saveRawInfo(root string, dir string) error {
+	order := "little"
+	// a big endian host reads the second byte as the low one
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		order = "big"
+	}
+	info := fmt.Sprintf("page_size: %d\nbyte_order: %s\n", PageSize(root), order)
+	return os.WriteFile(filepath.Join(dir, rawInfoFile), []byte(info), 0644)
+}
+
+// loadRawInfo reads the page size and byte order of a dump. Dumps
+// saved without them are read with the byte order of this host and the
+// page size of the page header.
+func (rt *RawTrace) loadRawInfo() error {
+	rt.PageSize = rt.PageHeader.PageSize
+	if rt.PageSize == 0 {
+		rt.PageSize = DefaultPageSize
+	}
+	rt.ByteOrder = binary.NativeEndian
+
+	text, err := os.ReadFile(filepath.Join(rt.Root, rawInfoFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(text), "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "page_size":
+			rt.PageSize, err = strconv.Atoi(value)
+			if err != nil || rt.PageSize <= 0 {
+				return fmt.Errorf("%s: invalid page size %q", rawInfoFile, value)
+			}
+		case "byte_order":
+			switch value {
+			case "little":
+				rt.ByteOrder = binary.LittleEndian
+			case "big":
+				rt.ByteOrder = binary.BigEndian
+			default:
+				return fmt.Errorf("%s: invalid byte order %q", rawInfoFile, value)
+			}
+		}
+	}
+	return nil
+}
+
+// IsRawDump reports whether dir holds per cpu raw buffers.
+func IsRawDump(dir string) bool {
+	return len(rawCPUs(dir)) != 0
+}
+
+// OpenRaw opens the raw buffers of a dump and loads the formats of the
+// given event systems from it.
+func OpenRaw(root string, systems ...string) (*RawTrace, error) {
+	var err error
+
+	rt := &RawTrace{Root: root}
+	rt.Schema, err = LoadSchema(root, systems...)
+	if err != nil {
+		return nil, err
+	}
+
+	headerPage, err := os.ReadFile(filepath.Join(root, "events", "header_page"))
+	if err != nil {
+		return nil, err
+	}
+	rt.PageHeader, err = ftrace.ParsePageHeader(string(headerPage))
+	if err != nil {
+		return nil, err
+	}
+	err = rt.loadRawInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	cmdlines, err := os.ReadFile(filepath.Join(root, "saved_cmdlines"))
+	if err == nil {
+		rt.Comms = ftrace.ParseCmdlines(string(cmdlines))
+	}
+
+	rt.CPUs = rawCPUs(root)
+	if len(rt.CPUs) == 0 {
+		return nil, fmt.Errorf("no per cpu raw buffers found below %s", root)
+	}
+	for _, cpu := range rt.CPUs {
+		file, err := os.Open(rawPath(root, cpu))
+		if err != nil {
+			rt.Close()
+			return nil, err
+		}
+		rt.files = append(rt.files, file)
+	}
+	return rt, nil
+}
+
+// Records returns all events of the dump merged by timestamp.
+func (rt *RawTrace) Records() *ftrace.Merger {
+	var readers []ftrace.RecordReader
+
+	rt.readers = nil
+	for i, file := range rt.files {
+		cr := ftrace.NewCPUReader(rt.CPUs[i], file, rt.ByteOrder,
+			rt.PageSize, rt.PageHeader)
+		rt.readers = append(rt.readers, cr)
+		readers = append(readers, cr)
+	}
+	return ftrace.NewMerger(readers...)
+}
+
+// Missed returns the event losses seen by the readers of the last
+// Records call.
+func (rt *RawTrace) Missed() []ftrace.Lost {
+	var missed []ftrace.Lost
+
+	for _, cr := range rt.readers {
+		missed = append(missed, cr.Missed()...)
+	}
+	return missed
+}
+
+func (rt *RawTrace) Decoder() *ftrace.Decoder {
+	var formats []*ftrace.EventFormat
+
+	for _, format := range rt.Schema.Events {
+		formats = append(formats, format)
+	}
+	return ftrace.NewDecoder(rt.ByteOrder, formats, rt.Comms)
+}
+
+func (rt *RawTrace) Close() error {
+	var err error
+
+	for _, file := range rt.files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// dumpCPU copies the raw pages of one cpu to out until stop is closed
+// and the buffer is drained.
+func dumpCPU(path string, out string, stop <-chan struct{}) error {
+	in, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(out), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if _, werr := file.Write(buf[:n]); werr != nil {
+				file.Close()
+				return werr
+			}
+			continue
+		}
+		if err != nil && err != io.EOF && !errors.Is(err, syscall.EAGAIN) {
+			file.Close()
+			return err
+		}
+		// buffer is empty
+		select {
+		case <-stop:
+			return file.Close()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// DumpRaw copies per_cpu/cpuN/trace_pipe_raw of all cpus below root to
+// dir until stop is closed. Tracing should be turned off before stop is
+// closed so that the buffers can be drained. The page header, page
+// size and byte order, cpu stats and saved_cmdlines are saved as well,
+// event formats are saved with SaveFormats.
+func DumpRaw(root string, dir string, stop <-chan struct{}) error {
+	var wg sync.WaitGroup
+
+	cpus := rawCPUs(root)
+	if len(cpus) == 0 {
+		return fmt.Errorf("no per cpu raw buffers found below %s", root)
+	}
+	err := copyFile(filepath.Join(root, "events", "header_page"),
+		filepath.Join(dir, "events", "header_page"))
+	if err != nil {
+		return err
+	}
+	err = saveRawInfo(root, dir)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(cpus))
+	for i, cpu := range cpus {
+		wg.Add(1)
+		go func(i int, cpu int) {
+			defer wg.Done()
+			errs[i] = dumpCPU(rawPath(root, cpu), rawPath(dir, cpu), stop)
+		}(i, cpu)
+	}
+	wg.Wait()
+
+	// pids seen and events lost are known only after the trace is done
+	err = copyFile(filepath.Join(root, "saved_cmdlines"),
+		filepath.Join(dir, "saved_cmdlines"))
+	if err == nil {
+		err = SaveStats(root, dir)
+	}
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package tracefs
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testdata/raw_le and raw_be are dumps of a little endian host with
+// 4K pages and of a big endian host with 8K pages. Their cpu1 page
+// has the missed events flag set.
+func TestRawReplay(t *testing.T) {
+	for _, test := range []struct {
+		dir      string
+		pageSize int
+		order    binary.ByteOrder
+	}{
+		{"testdata/raw_le", 4096, binary.LittleEndian},
+		{"testdata/raw_be", 8192, binary.BigEndian},
+	} {
+		rt, err := OpenRaw(test.dir, "kmem")
+		if err != nil {
+			t.Fatalf("%s: %v", test.dir, err)
+		}
+		defer rt.Close()
+		if rt.PageSize != test.pageSize || rt.ByteOrder != test.order {
+			t.Errorf("%s: page size %v byte order %v, want %v %v", test.dir,
+				rt.PageSize, rt.ByteOrder, test.pageSize, test.order)
+		}
+
+		var got []string
+		var ptrs []uint64
+		var lost int
+		records := rt.Records()
+		decoder := rt.Decoder()
+		for {
+			rec, err := records.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.dir, err)
+			}
+			if rec.Lost != nil {
+				if rec.CPU != 1 || rec.Lost.CPU != 1 {
+					t.Errorf("%s: loss on cpu %v before a record of cpu %v",
+						test.dir, rec.Lost.CPU, rec.CPU)
+				}
+				lost++
+			}
+			prefix, event, err := decoder.Decode(rec)
+			if err != nil {
+				t.Fatalf("%s: %v", test.dir, err)
+			}
+			if prefix.Pid != 1234 || prefix.Comm != "ibv_rc" {
+				t.Errorf("%s: pid %v comm %v", test.dir, prefix.Pid, prefix.Comm)
+			}
+			ptr, _ := event.Uint("ptr")
+			got = append(got, event.Name)
+			ptrs = append(ptrs, ptr)
+		}
+
+		want := []string{"kmalloc", "kmalloc", "kfree", "kmalloc"}
+		wantPtrs := []uint64{0xffff888100001000, 0xffff888100002000,
+			0xffff888100001000, 0xffff888100003000}
+		if len(got) != len(want) {
+			t.Fatalf("%s: events %v, want %v", test.dir, got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] || ptrs[i] != wantPtrs[i] {
+				t.Errorf("%s: event %d %v ptr=0x%x, want %v ptr=0x%x", test.dir,
+					i, got[i], ptrs[i], want[i], wantPtrs[i])
+			}
+		}
+		if lost != 1 || len(rt.Missed()) != 1 {
+			t.Errorf("%s: %v records after a loss, %v missed pages, want 1 and 1",
+				test.dir, lost, len(rt.Missed()))
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package tracefs reads event definitions from a tracefs mount or from
+// a saved copy of it with the same directory layout.
+package tracefs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Mellanox/kmtracker/ftrace"
+)
+
+const DefaultRoot = "/sys/kernel/debug/tracing"
+
+// DefaultPageSize is the page size of a trace which does not tell the
+// page size of the traced kernel.
+const DefaultPageSize = 4096
+
+// Schema holds the format of every loaded event keyed by event name.
+type Schema struct {
+	// tracefs root or saved copy the schema was loaded from
+	Root   string
+	Events map[string]*ftrace.EventFormat
+	// page size of the kernel, 0 when not known
+	PageSize int
+}
+
+// PageSize returns the page size of the kernel of the first root
+// having events/header_page, DefaultPageSize when none has it.
+func PageSize(roots ...string) int {
+	for _, root := range roots {
+		text, err := os.ReadFile(filepath.Join(root, "events", "header_page"))
+		if err != nil {
+			continue
+		}
+		hdr, err := ftrace.ParsePageHeader(string(text))
+		if err == nil && hdr.PageSize != 0 {
+			return hdr.PageSize
+		}
+	}
+	return DefaultPageSize
+}
+
+// LoadSchema loads events/<system>/*/format of the given systems below
+// root. root is a tracefs mount or a directory saved by SaveFormats.
+func LoadSchema(root string, systems ...string) (*Schema, error) {
+	schema := &Schema{Root: root, PageSize: PageSize(root)}
+	schema.Events = make(map[string]*ftrace.EventFormat)
+
+	for _, system := range systems {
+		formats := ftrace.LoadSystemFormats(root, system)
+		for name, format := range formats {
+			schema.Events[name] = format
+		}
+	}
+	if len(schema.Events) == 0 {
+		return nil, fmt.Errorf("no event formats found below %s", root)
+	}
+	return schema, nil
+}
+
+// NewSchema returns a schema of the given formats, such as the formats
+// embedded in a trace.dat file. source names where they come from.
+func NewSchema(source string, formats []*ftrace.EventFormat) *Schema {
+	schema := &Schema{Root: source}
+	schema.Events = make(map[string]*ftrace.EventFormat)
+	for _, format := range formats {
+		schema.Events[format.Name] = format
+	}
+	return schema
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SaveFormats copies the format files of the given systems and the
+// page header from root to dir, keeping the tracefs layout so that dir
+// can be loaded with LoadSchema later.
+func SaveFormats(root string, dir string, systems ...string) error {
+	err := copyFile(filepath.Join(root, "events", "header_page"),
+		filepath.Join(dir, "events", "header_page"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, system := range systems {
+		paths, err := filepath.Glob(filepath.Join(root, "events", system, "*", "format"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			err = copyFile(path, filepath.Join(dir, rel))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckFields returns a warning for every event or field in required
+// which the schema does not have. required maps event names to the
+// fields needed from them.
+func (schema *Schema) CheckFields(required map[string][]string) []string {
+	var warnings []string
+
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		format := schema.Events[name]
+		if format == nil {
+			warnings = append(warnings,
+				fmt.Sprintf("event %s is not defined", name))
+			continue
+		}
+		for _, field := range required[name] {
+			if _, ok := format.Kind(field); ok {
+				continue
+			}
+			if format.Field(field) != nil {
+				continue
+			}
+			warnings = append(warnings,
+				fmt.Sprintf("event %s has no field %s", name, field))
+		}
+	}
+	return warnings
+}
+
+// CheckEvent compares the fields of an event parsed from a text trace
+// with the fields its format prints. A difference means the trace was
+// not captured on the kernel the schema was loaded from.
+func (schema *Schema) CheckEvent(event *ftrace.Event) error {
+	format := schema.Events[event.Name]
+	if format == nil || len(format.PrintFields) == 0 {
+		return nil
+	}
+
+	var missing, extra []string
+	printed := make(map[string]bool)
+	for _, name := range format.PrintFields {
+		printed[name] = true
+		if !event.Has(name) {
+			missing = append(missing, name)
+		}
+	}
+	for name := range event.Fields {
+		if !printed[name] {
+			extra = append(extra, name)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	sort.Strings(extra)
+
+	msg := fmt.Sprintf("event %s does not match format from %s:", event.Name, schema.Root)
+	if len(missing) != 0 {
+		msg += " missing " + strings.Join(missing, ",")
+	}
+	if len(extra) != 0 {
+		msg += " unexpected " + strings.Join(extra, ",")
+	}
+	return fmt.Errorf("%s", msg)
+}
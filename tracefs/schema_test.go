@@ -0,0 +1,12 @@
+package tracefs
+
+import "testing"
+
+func TestPageSize(t *testing.T) {
+	if size := PageSize("testdata/missing", "testdata/page64k"); size != 65536 {
+		t.Errorf("page size %v, want 65536", size)
+	}
+	if size := PageSize("testdata/missing"); size != DefaultPageSize {
+		t.Errorf("page size %v, want %v", size, DefaultPageSize)
+	}
+}
@@ -0,0 +1,103 @@
+package tracefs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CPUStats is the content of per_cpu/cpuN/stats.
+type CPUStats struct {
+	CPU     int
+	Entries uint64
+	// events overwritten by newer ones, the oldest events are lost
+	Overrun uint64
+	// events rejected because the buffer was full, the newest are lost
+	Dropped uint64
+}
+
+func parseStats(cpu int, text string) *CPUStats {
+	stats := &CPUStats{CPU: cpu}
+	for _, line := range strings.Split(text, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "entries":
+			stats.Entries = value
+		case "overrun":
+			stats.Overrun = value
+		case "dropped events":
+			stats.Dropped = value
+		}
+	}
+	return stats
+}
+
+// Now returns the current time of the trace clock in seconds, read from
+// the "now ts" line of per_cpu/cpu0/stats of root. It returns 0 when the
+// time can not be read.
+func Now(root string) float64 {
+	data, err := os.ReadFile(filepath.Join(root, "per_cpu", "cpu0", "stats"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "now ts" {
+			continue
+		}
+		now, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return 0
+		}
+		return now
+	}
+	return 0
+}
+
+// LoadStats reads the stats of all cpus below root, a tracefs mount or
+// a directory saved by SaveStats.
+func LoadStats(root string) []*CPUStats {
+	var stats []*CPUStats
+
+	paths, _ := filepath.Glob(filepath.Join(root, "per_cpu", "cpu*", "stats"))
+	for _, path := range paths {
+		name := filepath.Base(filepath.Dir(path))
+		cpu, err := strconv.Atoi(strings.TrimPrefix(name, "cpu"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, parseStats(cpu, string(data)))
+	}
+	return stats
+}
+
+// SaveStats copies per_cpu/cpuN/stats of all cpus from root to dir.
+func SaveStats(root string, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(root, "per_cpu", "cpu*", "stats"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		err = copyFile(path, filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package tracefs
+
+import "testing"
+
+func TestLoadStats(t *testing.T) {
+	stats := LoadStats("testdata/stats")
+	if len(stats) != 2 {
+		t.Fatalf("%v cpus, want 2", len(stats))
+	}
+	for _, want := range []CPUStats{
+		{CPU: 0, Entries: 1024},
+		{CPU: 1, Entries: 4096, Overrun: 311, Dropped: 17},
+	} {
+		if got := *stats[want.CPU]; got != want {
+			t.Errorf("stats %+v, want %+v", got, want)
+		}
+	}
+	if now := Now("testdata/stats"); now != 9.25 {
+		t.Errorf("now %v, want 9.25", now)
+	}
+}
@@ -1,110 +1,264 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+
+	"github.com/Mellanox/kmtracker/ftrace"
 )
 
+// MapTraceToSymbol resolves the call sites of all entries of tracker.
 func MapTraceToSymbol(tracker *MemEntryTracker, symbols *KernelSymbols) {
-	var found bool
+	mapEntriesToSymbol(tracker.entries, symbols)
+}
 
-	for _, mementry := range tracker.entries {
-		found = false
-		for k, _ := range symbols.ModulesSymbols {
-			for _, sym := range symbols.ModulesSymbols[k].Symbols {
-				if mementry.call_site >= sym.StartAddress &&
-					mementry.call_site <= sym.EndAddress {
-					mementry.call_site_fn = sym.Name
-					found = true
-					break
-				}
-			}
-			if found == true {
-				break
-			}
+// mapEntriesToSymbol resolves the call sites of entries, symbol lookups
+// are spread over all cpus. Source lines are looked up once per call
+// site.
+func mapEntriesToSymbol(all []*MemEntry, symbols *KernelSymbols) {
+	var entries []*MemEntry
+	var addrs []uint64
+
+	for _, mementry := range all {
+		if mementry.call_site == 0 {
+			continue
+		}
+		entries = append(entries, mementry)
+		addrs = append(addrs, mementry.call_site)
+	}
+	for i, sym := range symbols.index.LookupAll(addrs) {
+		// modules reloaded while tracing had other symbols
+		sym = symbols.symbolAt(addrs[i], entries[i].timestamp, sym)
+		if sym == nil {
+			entries[i].call_site_fn = ""
+			continue
 		}
+		setCallSite(entries[i], sym)
+		entries[i].call_site_loc = symbols.SourceLocation(addrs[i], sym)
 	}
 }
 
+// callSiteText returns the call site of an entry followed by its
+// source line and inline chain when they are known.
+func callSiteText(mementry *MemEntry) string {
+	text := callSiteSymbol(mementry)
+	if loc := mementry.call_site_loc; loc != nil {
+		text += " " + loc.String()
+		if inlined := loc.Inlined(); len(inlined) != 0 {
+			text += " [" + inlined + "]"
+		}
+	}
+	return text
+}
+
 func printTrackerSummary(tracker *MemEntryTracker) {
 	fmt.Printf("Total %v size = %v bytes, called %v times\n",
 		tracker.name, tracker.size, tracker.count)
 }
 
 func printPairs(tracker *MemEntryTracker) {
-	var freeTracker string
-
 	if len(tracker.entries) != 0 {
 		fmt.Println("alloc_type, caller function, allocated_length(bytes), index_in_file")
 	}
-	switch tracker.name {
-	case "kmalloc":
-		freeTracker = "kfree"
-	case "kmalloc_node":
-		freeTracker = "kfree"
-	case "kmem_cache_alloc":
-		freeTracker = "kmem_cache_free"
-	default:
-		freeTracker = "unknown"
-	}
-
 	for _, mementry := range tracker.entries {
 		if len(mementry.call_site_fn) != 0 && mementry.freeEntry != nil {
-			fmt.Println(tracker.name, mementry.call_site_fn,
+			fmt.Println(tracker.name, callSiteText(mementry),
 				mementry.length, mementry.index)
-			fmt.Printf("%v %v %v %v\n", freeTracker, mementry.freeEntry.call_site_fn,
+			fmt.Printf("%v %v %v %v\n", mementry.freeEntry.call_type,
+				callSiteText(mementry.freeEntry),
 				mementry.freeEntry.length, mementry.freeEntry.index)
 		}
 	}
 }
 
-func printLoners(tracker *MemEntryTracker) {
+// lostWindow returns the window of lost events which may hide the
+// other half of an unpaired entry.
+func lostWindow(lost *ftrace.LostEvents, mementry *MemEntry) *ftrace.LostWindow {
+	if len(freeFamily(mementry.call_type)) != 0 {
+		return lost.WindowBefore(mementry.timestamp)
+	}
+	return lost.WindowAfter(mementry.timestamp)
+}
+
+func printLoners(tracker *MemEntryTracker, lost *ftrace.LostEvents) {
 	if len(tracker.entries) != 0 {
 		fmt.Println("alloc_type, caller function, allocated_length(bytes), index_in_file")
 	}
 	for _, mementry := range tracker.entries {
 		if len(mementry.call_site_fn) != 0 && mementry.freeEntry == nil {
-			fmt.Println(tracker.name, mementry.call_site_fn,
+			if w := lostWindow(lost, mementry); w != nil {
+				fmt.Println(tracker.name, callSiteText(mementry),
+					mementry.length, mementry.index, "(unreliable,", w.String()+")")
+				continue
+			}
+			fmt.Println(tracker.name, callSiteText(mementry),
 				mementry.length, mementry.index)
 		}
 	}
 }
+
+// printUsages prints outstanding memory by function, call site or
+// module.
+func printUsages(title string, usages []*callSiteUsage, group string) {
+	if len(usages) == 0 {
+		return
+	}
+	fmt.Println("-------------------------------------------------")
+	fmt.Printf("%s by %s:\n", title, group)
+	fmt.Printf("%12s %10s %8s %8s %8s %18s %18s  %s\n", "bytes", "objects",
+		"min", "max", "avg", "first", "last", groupColumn(group))
+	for _, usage := range usages {
+		fmt.Printf("%12v %10v %8v %8v %8v %18.6f %18.6f  %s\n", usage.bytes,
+			usage.count, usage.min, usage.max, usage.avg(), usage.first,
+			usage.last, usage.name)
+	}
+}
+
+// printOutstanding prints the allocations and the pages not freed by
+// function, call site or module, largest first. Pages have a call site
+// when the trace has the stacks of their allocations.
+func printOutstanding(memEntries *MemEntrieByType, group string) {
+	printUsages("Not freed allocations", groupOutstanding([]*MemEntryTracker{
+		&memEntries.kmalloc, &memEntries.kmalloc_node,
+		&memEntries.kmem_cache_alloc}, group), group)
+	printUsages("Not freed pages", groupOutstanding([]*MemEntryTracker{
+		&memEntries.mm_page_alloc}, group), group)
+}
+
+// mapSitesToSymbol resolves the call sites the waste was summed by.
+func mapSitesToSymbol(memEntries *MemEntrieByType, symbols *KernelSymbols) {
+	entries := make([]*MemEntry, 0, len(memEntries.siteEntries))
+	for _, e := range memEntries.siteEntries {
+		entries = append(entries, e)
+	}
+	mapEntriesToSymbol(entries, symbols)
+}
+
+// printWaste prints the bytes requested against the bytes allocated by
+// kmalloc size class and by function, call site or module.
+func printWaste(memEntries *MemEntrieByType, group string) {
+	if memEntries.waste == nil || memEntries.waste.Empty() {
+		return
+	}
+	report := memEntries.waste.Group(func(site string) string {
+		return groupKey(memEntries.siteEntries[site], group)
+	})
+	fmt.Println("-------------------------------------------------")
+	report.Print(groupColumn(group), 0)
+}
+
+// printLostEvents reports the windows of lost events and the
+// allocations not freed whose free may have been lost in them.
+func printLostEvents(memEntries *MemEntrieByType) {
+	var count, size uint64
+
+	lost := memEntries.lost
+	if len(lost.Windows) == 0 {
+		return
+	}
+	lost.Sort()
+	fmt.Println("-------------------------------------------------")
+	fmt.Println("Warning: the trace is incomplete, events were lost")
+	for _, w := range lost.Windows {
+		fmt.Println("\t" + w.String())
+	}
+	for _, tracker := range []*MemEntryTracker{&memEntries.kmalloc,
+		&memEntries.kmalloc_node, &memEntries.kmem_cache_alloc} {
+		for _, mementry := range tracker.entries {
+			if mementry.freeEntry == nil && lostWindow(lost, mementry) != nil {
+				count++
+				size += mementry.length
+			}
+		}
+	}
+	fmt.Printf("Not freed allocations in lost event windows = %v bytes, %v allocations\n",
+		size, count)
+}
+
 func main() {
 	var kernelfile string
 	var tracefile string
 	var err error
 	var pid int
 
-	if len(os.Args) != 4 && len(os.Args) != 5 {
-		fmt.Println("Usage:")
-		fmt.Printf("%s trace_file pid_to_analyse vmlinux_file\n", os.Args[0])
+	if len(os.Args) > 1 && os.Args[1] == "record" {
+		err = runRecord(os.Args[2:])
+		if err != nil {
+			fmt.Println("record:", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if len(os.Args) > 2 {
-		pid, err = strconv.Atoi(os.Args[2])
+	if len(os.Args) > 1 && os.Args[1] == "live" {
+		err = runLive(os.Args[2:])
 		if err != nil {
-			fmt.Printf("invalid pid")
-			return
+			fmt.Println("live:", err)
+			os.Exit(1)
 		}
+		return
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	formats := fs.String("formats", "",
+		"tracefs root or saved copy with the event formats of a text trace")
+	group := fs.String("group", GroupByFunction,
+		"group not freed allocations by function, call site or module")
+	symbols := fs.String("symbols", "",
+		"symbol snapshot saved by record to use instead of the running kernel")
+	var moduleDirs dirList
+	fs.Var(&moduleDirs, "modules",
+		"directory of built modules searched before /lib/modules, can be repeated")
+	fs.Usage = func() {
+		fmt.Println("Usage:")
+		fmt.Printf("%s [--formats dir] [--symbols snapshot.tar] [--modules dir] [--group function|site|module] trace_file pid_to_analyse vmlinux_file [-v]\n", os.Args[0])
+		fmt.Printf("%s record --pid pid [--duration d] [--output file] [--raw] [--tracefs dir] [--module-poll d] [--page-stacks]\n", os.Args[0])
+		fmt.Printf("%s live [--pid pid] [--pipe fifo] [--interval d] [--top n] [--vmlinux file] [--modules dir] [--group function|site|module] [--tracefs dir]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	args := fs.Args()
+
+	if len(args) != 3 && len(args) != 4 {
+		fs.Usage()
+		return
+	}
+	if err = checkGroup(*group); err != nil {
+		fmt.Println(err)
+		return
 	}
 
-	if len(os.Args) > 3 {
-		kernelfile = os.Args[3]
+	pid, err = strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Printf("invalid pid")
+		return
 	}
+	kernelfile = args[2]
+	tracefile = args[0]
 
-	tracefile = os.Args[1]
-	memEntries, errm := BuildMemEntries(tracefile, int32(pid))
+	// the verbose listings need every entry, not only the allocations
+	// not freed
+	verbose := len(args) > 3 && (args[3] == "verbose" || args[3] == "v" ||
+		args[3] == "-v")
+
+	memEntries, errm := BuildMemEntries(tracefile, int32(pid), *formats, verbose)
 	if errm != nil {
 		fmt.Printf("meme trneie")
 		return
 	}
-	newmap, err := GetLiveKernelSymbolMap(kernelfile)
+	snapshot, err := LoadSymbolSnapshot(tracefile, *symbols, memEntries.kallsyms)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	newmap, err := GetKernelSymbolMap(snapshot, kernelfile, moduleDirs)
 	if err != nil {
 		fmt.Printf("kernel")
 		return
 	}
+	newmap.SetModuleTimeline(memEntries.modules)
 
 	fmt.Println("Mapping trace entries with symbols, please wait...")
 	MapTraceToSymbol(&memEntries.kmalloc, newmap)
@@ -112,17 +266,17 @@ func main() {
 	MapTraceToSymbol(&memEntries.kmem_cache_alloc, newmap)
 	MapTraceToSymbol(&memEntries.kfree, newmap)
 	MapTraceToSymbol(&memEntries.kmem_cache_free, newmap)
+	mapSitesToSymbol(memEntries, newmap)
 
-	if len(os.Args) > 4 && (os.Args[4] == "verbose" || os.Args[4] == "v" ||
-		os.Args[4] == "-v") {
+	if verbose {
 		printPairs(&memEntries.kmalloc)
 		printPairs(&memEntries.kmalloc_node)
 		printPairs(&memEntries.kmem_cache_alloc)
-		printLoners(&memEntries.kmalloc)
-		printLoners(&memEntries.kmalloc_node)
-		printLoners(&memEntries.kmem_cache_alloc)
-		printLoners(&memEntries.kfree)
-		printLoners(&memEntries.kmem_cache_free)
+		printLoners(&memEntries.kmalloc, memEntries.lost)
+		printLoners(&memEntries.kmalloc_node, memEntries.lost)
+		printLoners(&memEntries.kmem_cache_alloc, memEntries.lost)
+		printLoners(&memEntries.kfree, memEntries.lost)
+		printLoners(&memEntries.kmem_cache_free, memEntries.lost)
 	}
 	printTrackerSummary(&memEntries.kmalloc)
 	printTrackerSummary(&memEntries.kmalloc_node)
@@ -131,10 +285,15 @@ func main() {
 	printTrackerSummary(&memEntries.kmem_cache_free)
 	printTrackerSummary(&memEntries.mm_page_alloc)
 	printTrackerSummary(&memEntries.mm_page_free)
+	printTrackerSummary(&memEntries.mm_page_free_batched)
 	fmt.Println("-------------------------------------------------")
 	fmt.Printf("Total alloc size = %v bytes\n", memEntries.allocSize)
 	fmt.Printf("Total free size = %v bytes\n", memEntries.freeSize)
 	fmt.Printf("Total page memory alloc size = %v bytes\n", memEntries.pageAllocSize)
 	fmt.Printf("Total page memory free size = %v bytes\n", memEntries.pageFreeSize)
 	fmt.Printf("Total kernel memory allocated = %v bytes\n", memEntries.allocSize-memEntries.freeSize)
+	printOutstanding(memEntries, *group)
+	printWaste(memEntries, *group)
+	printFreeIssues(memEntries, verbose)
+	printLostEvents(memEntries)
 }
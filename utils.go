@@ -50,3 +50,15 @@ func execShellCmd(cmd string) {
 func execShellCmdOutput(cmd string) string {
 	return execShellCmdInternal(cmd, false)
 }
+
+// dirList is a flag that can be given more than once.
+type dirList []string
+
+func (d *dirList) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dirList) Set(dir string) error {
+	*d = append(*d, dir)
+	return nil
+}